@@ -0,0 +1,172 @@
+package coap
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CredentialStore holds the keys devices authenticate with.
+type CredentialStore interface {
+	// Key returns the key of the device id; ok is false for unknown
+	// devices.
+	Key(id string) (key string, ok bool)
+}
+
+// Device is the identity a request authenticated with.
+type Device struct {
+	// ID is the value of the option identifying the device.
+	ID string
+	// Option is the option ID came in, GiterLabID or AccessID.
+	Option OptionID
+}
+
+// MemoryCredentialStore is a CredentialStore kept in memory.  It may
+// be used by multiple goroutines simultaneously.
+type MemoryCredentialStore struct {
+	mu   sync.RWMutex
+	keys map[string]string
+}
+
+// NewMemoryCredentialStore returns a store holding a copy of keys,
+// which maps device IDs to their keys.
+func NewMemoryCredentialStore(keys map[string]string) *MemoryCredentialStore {
+	s := &MemoryCredentialStore{keys: make(map[string]string, len(keys))}
+	for id, key := range keys {
+		s.keys[id] = key
+	}
+	return s
+}
+
+// Key implements CredentialStore.
+func (s *MemoryCredentialStore) Key(id string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+// Set sets the key of the device id.
+func (s *MemoryCredentialStore) Set(id, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]string)
+	}
+	s.keys[id] = key
+}
+
+// Delete forgets the device id.
+func (s *MemoryCredentialStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+}
+
+func (s *MemoryCredentialStore) replace(keys map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+// FileCredentialStore is a CredentialStore read from a file with one
+// device per line: its ID and its key separated by white space.
+// Blank lines and lines starting with # are ignored.
+type FileCredentialStore struct {
+	MemoryCredentialStore
+	path string
+}
+
+// LoadCredentialFile reads the credentials in the file at path.
+func LoadCredentialFile(path string) (*FileCredentialStore, error) {
+	s := &FileCredentialStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again, replacing all credentials.  On error
+// the credentials are left unchanged.
+func (s *FileCredentialStore) Reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected device ID and key", s.path, n)
+		}
+		keys[fields[0]] = fields[1]
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	s.replace(keys)
+	return nil
+}
+
+// credentials returns the device ID and key m carries, preferring
+// GiterLabID and GiterLabKey over AccessID and AccessKey.
+func credentials(m *Message) (dev Device, key string, ok bool) {
+	for _, o := range [][2]OptionID{{GiterLabID, GiterLabKey}, {AccessID, AccessKey}} {
+		id, ok := m.Option(o[0]).(string)
+		if !ok {
+			continue
+		}
+		key, _ := m.Option(o[1]).(string)
+		return Device{ID: id, Option: o[0]}, key, true
+	}
+	return Device{}, "", false
+}
+
+type authHandler struct {
+	h     Handler
+	store CredentialStore
+}
+
+func (a authHandler) ServeCOAP(w ResponseWriter, r *Request) {
+	dev, key, ok := credentials(r.Msg)
+	if ok {
+		want, known := a.store.Key(dev.ID)
+		ok = known && subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1
+	}
+	if !ok {
+		if debugEnable {
+			TraceInfo("[coap] Remote: %v, authentication of %q failed", r.RemoteAddr, dev.ID)
+		}
+		code := CCode(GiterlabErrnoIllegalKey)
+		if r.Dialect == DialectRFC {
+			// 7.00 is reserved for signaling to this peer
+			code = Unauthorized
+		}
+		w.WriteMsg(&Message{Code: code})
+		return
+	}
+
+	r2 := *r
+	r2.Device = &dev
+	a.h.ServeCOAP(w, &r2)
+}
+
+// AuthHandler returns a handler that authenticates requests by their
+// GiterLabID and GiterLabKey, or AccessID and AccessKey, options
+// against store before calling h with Request.Device set.  Requests
+// without credentials or with a wrong key are answered with
+// GiterlabErrnoIllegalKey, or 4.01 Unauthorized where the dialect
+// reads 7.xx codes as signaling.
+func AuthHandler(h Handler, store CredentialStore) Handler {
+	return authHandler{h, store}
+}
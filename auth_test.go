@@ -0,0 +1,99 @@
+package coap
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	data := "# devices\ndevice-1  key-1\n\ndevice-2\tkey-2\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Error writing credentials: %v", err)
+	}
+
+	s, err := LoadCredentialFile(path)
+	if err != nil {
+		t.Fatalf("Error loading credentials: %v", err)
+	}
+	if key, ok := s.Key("device-2"); !ok || key != "key-2" {
+		t.Errorf("Expected key-2, got %q %v", key, ok)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("device-1 new\nbroken\n"), 0600); err != nil {
+		t.Fatalf("Error writing credentials: %v", err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Errorf("Expected an error for a line without key")
+	}
+	if key, _ := s.Key("device-1"); key != "key-1" {
+		t.Errorf("Expected the old credentials to be kept, got %q", key)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("device-1 new\n"), 0600); err != nil {
+		t.Fatalf("Error writing credentials: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error reloading credentials: %v", err)
+	}
+	if key, _ := s.Key("device-1"); key != "new" {
+		t.Errorf("Expected the new key, got %q", key)
+	}
+	if _, ok := s.Key("device-2"); ok {
+		t.Errorf("Expected device-2 to be gone")
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	devices := make(chan Device, 1)
+	store := NewMemoryCredentialStore(map[string]string{"device-1": "secret"})
+	store.Set("legacy-1", "old")
+
+	mux := NewServeMux()
+	mux.Handle("/data", AuthHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		devices <- *r.Device
+		w.WriteMsg(&Message{Code: Changed})
+	}), store))
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, mux)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	tests := []struct {
+		idOpt, keyOpt OptionID
+		id, key       string
+		code          CCode
+	}{
+		{GiterLabID, GiterLabKey, "device-1", "secret", Changed},
+		{AccessID, AccessKey, "legacy-1", "old", Changed},
+		{GiterLabID, GiterLabKey, "device-1", "wrong", GiterlabErrnoIllegalKey},
+		{GiterLabID, GiterLabKey, "unknown", "secret", GiterlabErrnoIllegalKey},
+		{0, 0, "", "", GiterlabErrnoIllegalKey},
+	}
+	for _, test := range tests {
+		req := Message{Type: Confirmable, Code: POST}
+		req.SetPathString("/data")
+		if test.idOpt != 0 {
+			req.SetOption(test.idOpt, test.id)
+			req.SetOption(test.keyOpt, test.key)
+		}
+		m, err := c.Send(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		if m.Code != test.code {
+			t.Errorf("%q/%q: expected %v, got %v", test.id, test.key, test.code, m.Code)
+			continue
+		}
+		if test.code == Changed {
+			dev := <-devices
+			if dev.ID != test.id || dev.Option != test.idOpt {
+				t.Errorf("Unexpected device %+v", dev)
+			}
+		}
+	}
+}
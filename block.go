@@ -0,0 +1,456 @@
+package coap
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBlockSize is the largest block a Server sends, and the
+	// block size a Conn uses for uploads, unless configured otherwise.
+	DefaultBlockSize = 1024
+
+	// maxSZX is the largest block size exponent, 1024 byte blocks.
+	maxSZX = 6
+)
+
+// BlockOption is the value of a Block1 or Block2 option (RFC 7959
+// section 2.2).
+type BlockOption struct {
+	// Num is the number of the block within the body.
+	Num uint32
+	// More is set when more blocks follow.
+	More bool
+	// SZX is the block size exponent: blocks are 2**(SZX+4) bytes.
+	SZX uint8
+}
+
+// Size returns the block size in bytes.
+func (b BlockOption) Size() int {
+	return 1 << (b.SZX + 4)
+}
+
+func (b BlockOption) value() uint32 {
+	v := b.Num<<4 | uint32(b.SZX&0x7)
+	if b.More {
+		v |= 0x8
+	}
+	return v
+}
+
+// szxForSize returns the largest block size exponent whose blocks fit
+// in size bytes.
+func szxForSize(size int) uint8 {
+	szx := uint8(0)
+	for szx < maxSZX && 1<<(szx+5) <= size {
+		szx++
+	}
+	return szx
+}
+
+// Block gets the Block1 or Block2 option of this message.
+func (m Message) Block(o OptionID) (BlockOption, bool) {
+	v, ok := m.Option(o).(uint32)
+	if !ok {
+		return BlockOption{}, false
+	}
+	return BlockOption{
+		Num:  v >> 4,
+		More: v&0x8 != 0,
+		SZX:  uint8(v & 0x7),
+	}, true
+}
+
+// SetBlock sets the Block1 or Block2 option of this message.
+func (m *Message) SetBlock(o OptionID, b BlockOption) {
+	m.SetOption(o, b.value())
+}
+
+// blockCache keeps the full bodies of responses served block by block
+// so later blocks do not run the handler again.
+type blockCache struct {
+	mu      sync.Mutex
+	entries map[blockKey]*blockEntry
+	order   []blockKey
+}
+
+// blockKey identifies a body by peer, method and request URI.
+type blockKey struct {
+	addr string
+	code CCode
+	uri  string
+}
+
+type blockEntry struct {
+	expires time.Time
+	msg     Message
+}
+
+func newBlockKey(r *Request) blockKey {
+	uri := r.Msg.PathString()
+	for _, q := range r.Msg.optionStrings(URIQuery) {
+		uri += "?" + q
+	}
+	return blockKey{r.RemoteAddr.String(), r.Msg.Code, uri}
+}
+
+func (c *blockCache) get(key blockKey) (Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(time.Now())
+	e, ok := c.entries[key]
+	if !ok {
+		return Message{}, false
+	}
+	return e.msg, true
+}
+
+func (c *blockCache) put(key blockKey, m Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[blockKey]*blockEntry)
+	}
+	now := time.Now()
+	c.expire(now)
+	c.entries[key] = &blockEntry{expires: now.Add(ExchangeLifetime), msg: m}
+	c.order = append(c.order, key)
+}
+
+func (c *blockCache) expire(now time.Time) {
+	for len(c.order) > 0 {
+		key := c.order[0]
+		e, ok := c.entries[key]
+		if ok && now.Before(e.expires) {
+			return
+		}
+		if ok {
+			delete(c.entries, key)
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// blockSize returns the largest block the server sends.
+func (srv *Server) blockSize() int {
+	if srv.MaxBlockSize > 0 {
+		return srv.MaxBlockSize
+	}
+	return DefaultBlockSize
+}
+
+// serveBlock2 answers a request for a later block of a body cached by
+// an earlier request and reports whether it did.
+func (srv *Server) serveBlock2(w ResponseWriter, r *Request) bool {
+	b, ok := r.Msg.Block(Block2)
+	if !ok || b.Num == 0 {
+		return false
+	}
+	m, ok := srv.blocks.get(newBlockKey(r))
+	if !ok {
+		return false
+	}
+	bw := &block2Writer{ResponseWriter: w, srv: srv, r: r}
+	bw.WriteMsg(&m)
+	return true
+}
+
+// block2Writer splits a response larger than the negotiated block
+// size into Block2 blocks and sends the one requested.
+type block2Writer struct {
+	ResponseWriter
+	srv *Server
+	r   *Request
+
+	wrote bool
+}
+
+func (w *block2Writer) WriteMsg(m *Message) error {
+	if w.wrote {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	w.wrote = true
+
+	szx := szxForSize(w.srv.blockSize())
+	req, requested := w.r.Msg.Block(Block2)
+	if requested && req.SZX < szx {
+		szx = req.SZX
+	}
+	b := BlockOption{Num: req.Num, SZX: szx}
+	size := b.Size()
+	if p := w.r.peer; !requested && p != nil && !p.blockWise() {
+		// the client has not announced block-wise transfers in
+		// its CSM, so the response goes out whole
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	if !requested && len(m.Payload) <= size {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	body := m.Payload
+	off := int(b.Num) * size
+	if off >= len(body) && off > 0 {
+		return w.ResponseWriter.WriteMsg(&Message{Code: BadOption})
+	}
+	if len(body) > size {
+		// later blocks answer other requests, so their type,
+		// MessageID and token are filled in afresh
+		cached := *m
+		cached.Type, cached.MessageID, cached.Token = Confirmable, 0, nil
+		w.srv.blocks.put(newBlockKey(w.r), cached)
+	}
+
+	end := off + size
+	if end > len(body) {
+		end = len(body)
+	}
+	b.More = end < len(body)
+
+	rv := *m
+	rv.Payload = body[off:end]
+	rv.SetBlock(Block2, b)
+	if b.Num == 0 {
+		rv.SetOption(Size2, uint32(len(body)))
+	}
+	return w.ResponseWriter.WriteMsg(&rv)
+}
+
+// fetchBlocks retrieves the remaining blocks of a Block2 response and
+// returns the response with the whole body.
+func (c *Conn) fetchBlocks(ctx context.Context, req *Message, rv *Message, tokenCh chan *Message) (*Message, error) {
+	b, ok := rv.Block(Block2)
+	if !ok || !b.More || !isSuccess(rv.Code) {
+		return rv, nil
+	}
+
+	body := append([]byte(nil), rv.Payload...)
+	for b.More {
+		next := *req
+		next.MessageID = defaultMessageIDs.next(c.conn.RemoteAddr().String())
+		next.SetBlock(Block2, BlockOption{Num: b.Num + 1, SZX: b.SZX})
+
+		part, err := c.exchange(ctx, &next, tokenCh)
+		if err != nil {
+			return nil, err
+		}
+		if !isSuccess(part.Code) {
+			return part, nil
+		}
+		pb, ok := part.Block(Block2)
+		if !ok || pb.Num != b.Num+1 {
+			return nil, ErrBlockMismatch
+		}
+		body = append(body, part.Payload...)
+		b = pb
+		rv = part
+	}
+
+	full := *rv
+	full.Payload = body
+	full.RemoveOption(Block2)
+	return &full, nil
+}
+
+// DefaultMaxBodySize is the largest request body a Server reassembles
+// from Block1 blocks unless configured otherwise.
+const DefaultMaxBodySize = 1 << 20
+
+// block1Key identifies an upload by peer and Request-Tag, or by token
+// when the client sends no Request-Tag.
+type block1Key struct {
+	addr string
+	tag  string
+}
+
+// partialBody is an upload still waiting for its last block.
+type partialBody struct {
+	expires time.Time
+	body    []byte
+}
+
+// block1Assembler collects the blocks of Block1 uploads.  Uploads that
+// see no new block for ExchangeLifetime are dropped.
+type block1Assembler struct {
+	mu      sync.Mutex
+	entries map[block1Key]*partialBody
+}
+
+func newBlock1Key(r *Request) block1Key {
+	tag, ok := r.Msg.Option(RequestTag).([]byte)
+	if !ok {
+		tag = r.Msg.Token
+	}
+	return block1Key{r.RemoteAddr.String(), string(tag)}
+}
+
+// add appends the block b of an upload and returns the whole body
+// once the last block arrived.  It returns RequestEntityIncomplete
+// for a block out of order and RequestEntityTooLarge when the body
+// would exceed max.
+func (a *block1Assembler) add(key block1Key, b BlockOption, payload []byte, max int) ([]byte, CCode) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, p := range a.entries {
+		if !now.Before(p.expires) {
+			delete(a.entries, k)
+		}
+	}
+	if a.entries == nil {
+		a.entries = make(map[block1Key]*partialBody)
+	}
+
+	p, ok := a.entries[key]
+	if b.Num == 0 {
+		p = &partialBody{}
+	} else if !ok || int(b.Num)*b.Size() != len(p.body) {
+		delete(a.entries, key)
+		return nil, RequestEntityIncomplete
+	}
+	if len(p.body)+len(payload) > max {
+		delete(a.entries, key)
+		return nil, RequestEntityTooLarge
+	}
+	p.body = append(p.body, payload...)
+
+	if b.More {
+		p.expires = now.Add(ExchangeLifetime)
+		a.entries[key] = p
+		return nil, Continue
+	}
+	delete(a.entries, key)
+	return p.body, 0
+}
+
+// maxBodySize returns the largest request body the server accepts.
+func (srv *Server) maxBodySize() int {
+	if srv.MaxBodySize > 0 {
+		return srv.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// assembleBlock1 collects the blocks of a Block1 upload, answering
+// each block but the last itself.  Once the upload is complete it
+// returns the request with the whole body and a writer that
+// acknowledges the last block; until then ok is false.
+func (srv *Server) assembleBlock1(w ResponseWriter, r *Request) (ResponseWriter, *Request, bool) {
+	b, ok := r.Msg.Block(Block1)
+	if !ok {
+		return w, r, true
+	}
+
+	max := srv.maxBodySize()
+	if size, ok := r.Msg.Option(Size1).(uint32); ok && int(size) > max {
+		rejectTooLarge(w, max)
+		return nil, nil, false
+	}
+
+	// ask for smaller blocks if the client's are larger than ours
+	szx := szxForSize(srv.blockSize())
+	if b.SZX < szx {
+		szx = b.SZX
+	}
+
+	body, code := srv.uploads.add(newBlock1Key(r), b, r.Msg.Payload, max)
+	switch code {
+	case 0:
+	case Continue:
+		rv := &Message{Code: Continue}
+		rv.SetBlock(Block1, BlockOption{Num: b.Num, More: true, SZX: szx})
+		w.WriteMsg(rv)
+		return nil, nil, false
+	case RequestEntityTooLarge:
+		rejectTooLarge(w, max)
+		return nil, nil, false
+	default:
+		w.WriteMsg(&Message{Code: code})
+		return nil, nil, false
+	}
+
+	msg := *r.Msg
+	msg.Payload = body
+	msg.RemoveOption(Block1)
+	msg.RemoveOption(Size1)
+	r2 := *r
+	r2.Msg = &msg
+	b.SZX = szx
+	return &block1Writer{ResponseWriter: w, b: b}, &r2, true
+}
+
+// rejectTooLarge answers with 4.13 Request Entity Too Large and the
+// largest body the server accepts.
+func rejectTooLarge(w ResponseWriter, max int) {
+	rv := &Message{Code: RequestEntityTooLarge}
+	rv.SetOption(Size1, uint32(max))
+	w.WriteMsg(rv)
+}
+
+// block1Writer acknowledges the last block of an upload on the
+// response the handler writes.
+type block1Writer struct {
+	ResponseWriter
+	b BlockOption
+
+	wrote bool
+}
+
+func (w *block1Writer) WriteMsg(m *Message) error {
+	if !w.wrote && !m.IsEmpty() {
+		w.wrote = true
+		m.SetBlock(Block1, w.b)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// sendBlocks uploads the payload of the confirmable request m in
+// Block1 blocks and returns the response to the last block.  The
+// server may ask for smaller blocks in its 2.31 Continue or 4.13
+// responses; the upload then goes on, or starts over, with those.
+func (c *Conn) sendBlocks(ctx context.Context, m *Message, tokenCh chan *Message) (*Message, error) {
+	body := m.Payload
+	szx := szxForSize(c.blockSize)
+	off := 0
+	for {
+		b := BlockOption{SZX: szx}
+		size := b.Size()
+		b.Num = uint32(off / size)
+		end := off + size
+		if end > len(body) {
+			end = len(body)
+		}
+		b.More = end < len(body)
+
+		part := *m
+		if off > 0 {
+			part.MessageID = defaultMessageIDs.next(c.conn.RemoteAddr().String())
+		}
+		part.Payload = body[off:end]
+		part.SetBlock(Block1, b)
+		if off == 0 {
+			part.SetOption(Size1, uint32(len(body)))
+		}
+
+		rv, err := c.exchange(ctx, &part, tokenCh)
+		if err != nil || rv == nil {
+			return rv, err
+		}
+		ack, ok := rv.Block(Block1)
+		switch {
+		case rv.Code == RequestEntityTooLarge && ok && ack.SZX < szx:
+			// the server wants smaller blocks; start over
+			szx, off = ack.SZX, 0
+			continue
+		case rv.Code != Continue || !b.More:
+			return rv, nil
+		}
+		if ok && ack.SZX < szx {
+			szx = ack.SZX
+		}
+		off = end
+	}
+}
@@ -0,0 +1,187 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockOption(t *testing.T) {
+	tests := []BlockOption{
+		{Num: 0, More: true, SZX: 0},
+		{Num: 5, More: false, SZX: 6},
+		{Num: 1 << 19, More: true, SZX: 2},
+	}
+	for _, b := range tests {
+		m := Message{Type: Confirmable, Code: GET, MessageID: 1}
+		m.SetBlock(Block2, b)
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Error encoding %+v: %v", b, err)
+		}
+		parsed, err := ParseMessage(data)
+		if err != nil {
+			t.Fatalf("Error parsing %+v: %v", b, err)
+		}
+		got, ok := parsed.Block(Block2)
+		if !ok || got != b {
+			t.Errorf("Expected %+v, got %+v", b, got)
+		}
+	}
+	if _, ok := (Message{}).Block(Block1); ok {
+		t.Errorf("Expected no Block1 option")
+	}
+	if size := (BlockOption{SZX: 2}).Size(); size != 64 {
+		t.Errorf("Expected block size 64, got %d", size)
+	}
+}
+
+func TestBlock2Transfer(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 50)
+	var calls int32
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteMsg(&Message{Code: Content, Payload: body})
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	server := &Server{Handler: handler, MaxBlockSize: 64}
+	go server.Serve(udpListener)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/firmware")
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if !bytes.Equal(m.Payload, body) {
+		t.Errorf("Expected the whole body, got %d bytes", len(m.Payload))
+	}
+	if m.Option(Block2) != nil {
+		t.Errorf("Expected Block2 to be stripped, got %v", m.Option(Block2))
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", calls)
+	}
+
+	// the client asks for smaller blocks than the server's maximum
+	req.SetBlock(Block2, BlockOption{Num: 3, SZX: 1})
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	b, ok := m.Block(Block2)
+	if !ok || b.Num != 3 || b.SZX != 1 || !b.More {
+		t.Errorf("Expected block 3 of size 32, got %+v", b)
+	}
+	if !bytes.Equal(m.Payload, body[96:128]) {
+		t.Errorf("Expected bytes 96-128, got %q", m.Payload)
+	}
+
+	req.SetBlock(Block2, BlockOption{Num: 100, SZX: 2})
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != BadOption {
+		t.Errorf("Expected %v for a block past the end, got %v", BadOption, m.Code)
+	}
+}
+
+func TestBlock2TransferFuncHandler(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 300)
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   body,
+		}
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+
+	req := Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/firmware")
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if !bytes.Equal(m.Payload, body) {
+		t.Errorf("Expected the whole body, got %d bytes", len(m.Payload))
+	}
+}
+
+func TestBlock1Transfer(t *testing.T) {
+	body := bytes.Repeat([]byte("diagnostic dump "), 40)
+	var calls int32
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		atomic.AddInt32(&calls, 1)
+		if !bytes.Equal(r.Msg.Payload, body) {
+			t.Errorf("Expected the whole upload, got %d bytes", len(r.Msg.Payload))
+		}
+		if r.Msg.Option(Block1) != nil {
+			t.Errorf("Expected Block1 to be stripped, got %v", r.Msg.Option(Block1))
+		}
+		w.WriteMsg(&Message{Code: Changed})
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	server := &Server{Handler: handler, MaxBlockSize: 64, MaxBodySize: 1024}
+	go server.Serve(udpListener)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.blockSize = 128
+
+	req := Message{Type: Confirmable, Code: POST, Payload: body}
+	req.SetPathString("/log")
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != Changed {
+		t.Errorf("Expected %v, got %v", Changed, m.Code)
+	}
+	// the server asked for 64 byte blocks after the first one
+	b, ok := m.Block(Block1)
+	if !ok || b.More || b.SZX != 2 || b.Num != 9 {
+		t.Errorf("Expected the last 64 byte block to be acknowledged, got %+v", b)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", calls)
+	}
+
+	req.Payload = bytes.Repeat(body, 2)
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != RequestEntityTooLarge || m.Option(Size1) != uint32(1024) {
+		t.Errorf("Expected %v with Size1 1024, got %v %v", RequestEntityTooLarge, m.Code, m.Option(Size1))
+	}
+
+	req.Payload = []byte("stray")
+	req.SetBlock(Block1, BlockOption{Num: 3, More: true, SZX: 2})
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != RequestEntityIncomplete {
+		t.Errorf("Expected %v for a block out of order, got %v", RequestEntityIncomplete, m.Code)
+	}
+}
@@ -1,7 +1,16 @@
 package coap
 
 import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -14,53 +23,474 @@ const (
 	// MaxRetransmit is the maximum number of times a message will
 	// be retransmitted.
 	MaxRetransmit = 4
+	// ExchangeLifetime is the time from starting to send a
+	// confirmable message to the time when an acknowledgement is
+	// no longer expected (RFC 7252 section 4.8.2).
+	ExchangeLifetime = time.Second * 247
+	// NonLifetime is the time from sending a non-confirmable
+	// message to the time its MessageID can be safely reused
+	// (RFC 7252 section 4.8.2).
+	NonLifetime = time.Second * 145
 )
 
+// Client errors.
+var (
+	// ErrTimeout is returned when a confirmable message is still not
+	// answered after MaxRetransmit retransmissions.
+	ErrTimeout = errors.New("no response after max retransmit")
+	// ErrReset is returned when the peer rejects a message with Reset.
+	ErrReset = errors.New("message rejected with reset")
+	// ErrTokenInUse is returned when a request reuses the token of
+	// another request still in flight on the same connection.
+	ErrTokenInUse = errors.New("token already in use")
+	// ErrBlockMismatch is returned when a block-wise response does
+	// not carry the block that was requested.
+	ErrBlockMismatch = errors.New("unexpected block in response")
+)
+
+// tokenLen is the length of tokens generated for requests sent
+// without one.
+const tokenLen = 8
+
 // Conn is a CoAP client connection.
+//
+// A Conn may be used by multiple goroutines simultaneously.  A
+// background reader hands every incoming message to the request it
+// answers; messages that answer no request are queued for Receive.
+// Confirmable messages are always acknowledged and retransmitted ones
+// are dropped.
 type Conn struct {
-	conn *net.UDPConn
-	buf  []byte
+	conn net.Conn
+
+	ackTimeout      time.Duration
+	maxRetransmit   int
+	separateTimeout time.Duration
+	// blockSize is the size of the Block1 blocks large request
+	// payloads are split into.
+	blockSize int
+	// crcTable, if set, stamps requests with payloads with their
+	// CRC32.
+	crcTable *crc32.Table
+
+	mu     sync.Mutex
+	tokens map[string]chan *Message
+	mids   map[uint16]chan *Message
+
+	incoming chan *Message
+	done     chan struct{}
+	err      error
+
+	// seen holds the MessageIDs of the confirmable and
+	// non-confirmable messages received, to drop retransmissions.
+	seen *dedupCache
 }
 
-// Dial connects a CoAP client.
+// Dial connects a CoAP client over a datagram network such as "udp"
+// or "unixgram".
 func Dial(n, addr string) (*Conn, error) {
-	uaddr, err := net.ResolveUDPAddr(n, addr)
+	s, err := net.Dial(n, addr)
 	if err != nil {
 		return nil, err
 	}
+	return NewConn(s), nil
+}
+
+// NewConn runs a CoAP client over the established datagram connection
+// c, for instance a DTLS session.  Each Read of c must return one
+// message and each Write must send one.
+func NewConn(c net.Conn) *Conn {
+	cc := &Conn{
+		conn:            c,
+		ackTimeout:      ResponseTimeout,
+		maxRetransmit:   MaxRetransmit,
+		separateTimeout: ExchangeLifetime,
+		blockSize:       DefaultBlockSize,
+		tokens:          make(map[string]chan *Message),
+		mids:            make(map[uint16]chan *Message),
+		incoming:        make(chan *Message, 16),
+		seen:            newDedupCache(),
+		done:            make(chan struct{}),
+	}
+	go cc.readLoop()
+	return cc
+}
 
-	s, err := net.DialUDP("udp", nil, uaddr)
+// NewPacketConn runs a CoAP client talking to addr over the packet
+// connection l.  Packets from other addresses are dropped.  Closing
+// the client closes l.
+func NewPacketConn(l net.PacketConn, addr net.Addr) *Conn {
+	return NewConn(&packetConn{PacketConn: l, raddr: addr})
+}
+
+// packetConn is the net.Conn of a packet connection talking to a
+// single peer.
+type packetConn struct {
+	net.PacketConn
+	raddr net.Addr
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	for {
+		n, a, err := c.ReadFrom(b)
+		if err != nil || a.String() == c.raddr.String() {
+			return n, err
+		}
+	}
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// NewDTLSConn is NewConn for an established DTLS session, such as one
+// dialed by package dtls.
+func NewDTLSConn(c net.Conn) *Conn {
+	return NewConn(c)
+}
+
+// Close closes the connection.  Requests in flight fail with
+// net.ErrClosed.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// initialTimeout picks a random timeout between ackTimeout and
+// ackTimeout * ResponseRandomFactor (RFC 7252 section 4.2).
+func initialTimeout(ackTimeout time.Duration) time.Duration {
+	spread := float64(ackTimeout) * (ResponseRandomFactor - 1)
+	return ackTimeout + time.Duration(rand.Int63n(int64(spread)+1))
+}
+
+// newToken generates a random token for a request.
+func newToken() []byte {
+	tok := make([]byte, tokenLen)
+	if _, err := crand.Read(tok); err != nil {
+		rand.Read(tok)
+	}
+	return tok
+}
+
+// readLoop reads messages until the connection is closed and routes
+// them: ACK and Reset by MessageID, everything else by Token.
+func (c *Conn) readLoop() {
+	buf := make([]byte, maxPktLen)
+	for {
+		nr, err := c.conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && err != io.EOF && c.closedErr() == nil {
+				// e.g. ICMP port unreachable reported on the socket
+				TraceInfo("[coap] client read error: %s", err)
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = net.ErrClosed
+			}
+			c.mu.Unlock()
+			close(c.done)
+			return
+		}
+
+		data := make([]byte, nr)
+		copy(data, buf)
+		msg, err := ParseMessage(data)
+		if err != nil {
+			TraceInfo("[coap] discarding malformed message: %s", err)
+			continue
+		}
+		c.route(&msg)
+	}
+}
+
+func (c *Conn) route(msg *Message) {
+	var key dedupKey
+	if msg.Type == Confirmable || msg.Type == NonConfirmable {
+		lifetime := ExchangeLifetime
+		if msg.Type == NonConfirmable {
+			lifetime = NonLifetime
+		}
+		key = dedupKey{mid: msg.MessageID}
+		if reply, dup := c.seen.lookup(key, lifetime); dup {
+			// the ACK or Reset sent for the original may have
+			// been lost
+			if reply != nil {
+				c.conn.Write(reply)
+			}
+			TraceInfo("[coap] discarding duplicate %v, MessageID: %d", msg.Type, msg.MessageID)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	var ch chan *Message
+	switch msg.Type {
+	case Acknowledgement, Reset:
+		ch = c.mids[msg.MessageID]
+	default:
+		ch = c.tokens[string(msg.Token)]
+	}
+	c.mu.Unlock()
+
+	if ch == nil {
+		switch msg.Type {
+		case Acknowledgement, Reset:
+			TraceInfo("[coap] discarding unmatched %v, MessageID: %d", msg.Type, msg.MessageID)
+		case Confirmable:
+			// nobody waits for it, for instance a notification of
+			// an observation that has ended (RFC 7641 section 3.6)
+			TraceInfo("[coap] rejecting unsolicited %v %s, MessageID: %d", msg.Type,
+				DialectGiterLab.CodeString(msg.Code), msg.MessageID)
+			c.reply(key, &Message{Type: Reset, MessageID: msg.MessageID})
+		default:
+			select {
+			case c.incoming <- msg:
+			default:
+				TraceInfo("[coap] discarding unsolicited %v %s, MessageID: %d", msg.Type,
+					DialectGiterLab.CodeString(msg.Code), msg.MessageID)
+			}
+		}
+		return
+	}
+
+	if msg.IsConfirmable() {
+		// acknowledge separate responses and notifications
+		c.reply(key, &Message{Type: Acknowledgement, MessageID: msg.MessageID})
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+// registerToken routes messages carrying token to ch.
+func (c *Conn) registerToken(token []byte, ch chan *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.tokens[string(token)]; ok {
+		return ErrTokenInUse
+	}
+	c.tokens[string(token)] = ch
+	return nil
+}
+
+// rebindToken routes the messages for token to ch from now on.
+func (c *Conn) rebindToken(token []byte, ch chan *Message) {
+	c.mu.Lock()
+	c.tokens[string(token)] = ch
+	c.mu.Unlock()
+}
+
+func (c *Conn) unregisterToken(token []byte) {
+	c.mu.Lock()
+	delete(c.tokens, string(token))
+	c.mu.Unlock()
+}
+
+func (c *Conn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// reply sends the ACK or Reset m for the message recorded under key,
+// and keeps it to answer retransmissions of that message.
+func (c *Conn) reply(key dedupKey, m *Message) {
+	d, err := m.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return
+	}
+	c.seen.respond(key, d)
+	c.conn.Write(d)
+}
+
+// prepare copies req, generating a token and MessageID if unset.  The
+// options are copied too, so that req is never shared with the exchange.
+func (c *Conn) prepare(req *Message) Message {
+	m := *req
+	m.opts = append(options(nil), req.opts...)
+	if len(m.Token) == 0 {
+		m.Token = newToken()
+	}
+	if m.MessageID == 0 {
+		m.MessageID = defaultMessageIDs.next(c.conn.RemoteAddr().String())
 	}
+	if c.crcTable != nil && len(m.Payload) > 0 && m.Option(CheckCRC32) == nil {
+		m.SetCRC32(c.crcTable)
+	}
+	return m
+}
 
-	return &Conn{s, make([]byte, maxPktLen)}, nil
+// SetCRC32 makes the client stamp the requests it sends that have a
+// payload with the CheckCRC32 option, computed with tab.  Requests
+// that carry the option already are left alone.  A nil tab turns
+// stamping off.  Call it before sending requests.
+func (c *Conn) SetCRC32(tab *crc32.Table) {
+	c.crcTable = tab
 }
 
-// Send a message.  Get a response if there is one.
-func (c *Conn) Send(req Message) (*Message, error) {
-	err := Transmit(c.conn, nil, req)
+// Do sends a request and waits for its response.
+//
+// A random token is generated when req has none, and a MessageID
+// is allocated when req.MessageID is zero.  Confirmable requests are
+// retransmitted with exponential backoff until a matching response
+// arrives or MaxRetransmit retransmissions have been made, in which
+// case ErrTimeout is returned.  When the peer acknowledges with an
+// empty ACK, Do keeps waiting for the separate response (RFC 7252
+// section 5.2.2).  Non-confirmable requests are sent once and Do
+// returns no response.
+//
+// Do gives up when ctx is done and returns ctx.Err().
+//
+// A payload larger than one block is uploaded in Block1 blocks, and a
+// response split into Block2 blocks (RFC 7959) is reassembled by
+// fetching the remaining blocks, unless req asks for a block itself.
+//
+// A request suppressing every response with FlagNoAck or No-Response
+// (RFC 7967) returns no response once the server acknowledges it.  One
+// suppressing only some classes waits for a separate response for the
+// ACK timeout after an empty ACK, and returns no response if none
+// arrives.
+func (c *Conn) Do(ctx context.Context, req *Message) (*Message, error) {
+	m := c.prepare(req)
+	if !m.IsConfirmable() {
+		return nil, send(c.conn, &m)
+	}
+
+	tokenCh := make(chan *Message, 1)
+	err := c.registerToken(m.Token, tokenCh)
 	if err != nil {
 		return nil, err
 	}
+	defer c.unregisterToken(m.Token)
 
-	if !req.IsConfirmable() {
-		return nil, nil
+	var rv *Message
+	if len(m.Payload) > c.blockSize && m.Option(Block1) == nil {
+		rv, err = c.sendBlocks(ctx, &m, tokenCh)
+		// later blocks of the response are fetched without the body
+		m.Payload = nil
+	} else {
+		rv, err = c.exchange(ctx, &m, tokenCh)
+	}
+	if err != nil || rv == nil || m.Option(Block2) != nil {
+		// a caller asking for a block itself gets just that block
+		return rv, err
 	}
+	return c.fetchBlocks(ctx, &m, rv, tokenCh)
+}
 
-	rv, err := Receive(c.conn, c.buf)
+// exchange transmits the confirmable request m and waits for the
+// response, which arrives either piggybacked on the ACK or on
+// tokenCh.
+func (c *Conn) exchange(ctx context.Context, m *Message, tokenCh chan *Message) (*Message, error) {
+	midCh := make(chan *Message, 1)
+	c.mu.Lock()
+	c.mids[m.MessageID] = midCh
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.mids, m.MessageID)
+		c.mu.Unlock()
+	}()
+
+	// retransmissions resend the same bytes
+	d, err := marshalFor(c.conn, m)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := c.conn.Write(d); err != nil {
+		return nil, err
+	}
+
+	timeout := initialTimeout(c.ackTimeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	acked := false
+	retransmits := 0
+
+	for {
+		select {
+		case rv := <-midCh:
+			if rv.Type == Reset {
+				return nil, ErrReset
+			}
+			if !rv.IsEmpty() {
+				if !bytes.Equal(rv.Token, m.Token) {
+					TraceInfo("[coap] discarding ACK with mismatched token, MessageID: %d", rv.MessageID)
+					continue
+				}
+				return rv, nil
+			}
+			if wantsNoResponse(m) {
+				// the server only acknowledges
+				return nil, nil
+			}
+			if !acked {
+				acked = true
+				if !timer.Stop() {
+					<-timer.C
+				}
+				wait := c.separateTimeout
+				if suppressedClasses(m) != 0 {
+					// the response may have been suppressed, so
+					// give a separate one only a short while
+					wait = c.ackTimeout
+				}
+				timer.Reset(wait)
+			}
+		case rv := <-tokenCh:
+			return rv, nil
+		case <-timer.C:
+			if acked && suppressedClasses(m) != 0 {
+				return nil, nil
+			}
+			if acked || retransmits >= c.maxRetransmit {
+				return nil, ErrTimeout
+			}
+			retransmits++
+			if _, err := c.conn.Write(d); err != nil {
+				return nil, err
+			}
+			timeout *= 2
+			timer.Reset(timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, c.closedErr()
+		}
+	}
+}
 
-	return &rv, nil
+// Send a message.  Get a response if there is one.
+//
+// Send is Do without a context.
+func (c *Conn) Send(req Message) (*Message, error) {
+	return c.Do(context.Background(), &req)
 }
 
-// Receive a message.
+// Receive a non-confirmable message that did not answer any request
+// sent on this connection; confirmable ones are rejected with Reset.
+// It gives up after ResponseTimeout.
 func (c *Conn) Receive() (*Message, error) {
-	rv, err := Receive(c.conn, c.buf)
-	if err != nil {
-		return nil, err
+	timer := time.NewTimer(ResponseTimeout)
+	defer timer.Stop()
+
+	select {
+	case rv := <-c.incoming:
+		return rv, nil
+	case <-timer.C:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return nil, c.closedErr()
 	}
-	return &rv, nil
 }
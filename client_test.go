@@ -0,0 +1,360 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dialTest(t *testing.T, addr string) *Conn {
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	c.ackTimeout = 10 * time.Millisecond
+	return c
+}
+
+func TestSendRetransmitsUntilAnswered(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	transmissions := make(chan int, 1)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		for n := 1; ; n++ {
+			nr, addr, err := udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 3 {
+				// drop the first two transmissions
+				continue
+			}
+			req, _ := ParseMessage(buf[:nr])
+			Transmit(udpListener, addr, Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: req.MessageID,
+				Token:     req.Token,
+			})
+			transmissions <- n
+			return
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	m, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 1})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != Content {
+		t.Errorf("Expected code %v, got %v", Content, m.Code)
+	}
+	if n := <-transmissions; n != 3 {
+		t.Errorf("Expected 3 transmissions, got %v", n)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	received := make(chan time.Time, 16)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		for {
+			_, _, err := udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			received <- time.Now()
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	c.maxRetransmit = 2
+	_, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 2})
+	if err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+
+	var at []time.Time
+	for len(received) > 0 {
+		at = append(at, <-received)
+	}
+	if len(at) != 3 {
+		t.Fatalf("Expected 3 transmissions, got %v", len(at))
+	}
+	if first, second := at[1].Sub(at[0]), at[2].Sub(at[1]); second < first {
+		t.Errorf("Expected backoff to grow, got %v then %v", first, second)
+	}
+}
+
+func TestSendDiscardsUnmatched(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	go func() {
+		buf := make([]byte, maxPktLen)
+		nr, addr, err := udpListener.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, _ := ParseMessage(buf[:nr])
+		if len(req.Token) != tokenLen {
+			t.Errorf("Expected a generated %d byte token, got %#v", tokenLen, req.Token)
+		}
+		// a stale ACK, a response to another request, then the answer
+		Transmit(udpListener, addr, Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: req.MessageID - 1,
+			Token:     req.Token,
+			Payload:   []byte("stale"),
+		})
+		Transmit(udpListener, addr, Message{
+			Type:      NonConfirmable,
+			Code:      Content,
+			MessageID: 77,
+			Token:     []byte("other"),
+			Payload:   []byte("other"),
+		})
+		Transmit(udpListener, addr, Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: req.MessageID,
+			Token:     req.Token,
+			Payload:   []byte("answer"),
+		})
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	c.ackTimeout = time.Second
+	m, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 3})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if string(m.Payload) != "answer" {
+		t.Errorf("Expected the matching response, got %q", m.Payload)
+	}
+}
+
+func TestSendReset(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	go func() {
+		buf := make([]byte, maxPktLen)
+		nr, addr, err := udpListener.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, _ := ParseMessage(buf[:nr])
+		Transmit(udpListener, addr, Message{Type: Reset, MessageID: req.MessageID})
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	c.ackTimeout = time.Second
+	_, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 4})
+	if err != ErrReset {
+		t.Fatalf("Expected ErrReset, got %v", err)
+	}
+}
+
+func TestSendSeparateResponse(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	acked := make(chan Message, 1)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		nr, addr, err := udpListener.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, _ := ParseMessage(buf[:nr])
+		Transmit(udpListener, addr, Message{Type: Acknowledgement, MessageID: req.MessageID})
+
+		// let the client's retransmission timer expire before replying
+		time.Sleep(50 * time.Millisecond)
+		Transmit(udpListener, addr, Message{
+			Type:      Confirmable,
+			Code:      Content,
+			MessageID: 4321,
+			Token:     req.Token,
+			Payload:   []byte("separate"),
+		})
+
+		for i := 0; i < 2; i++ {
+			nr, _, err = udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			ack, _ := ParseMessage(buf[:nr])
+			acked <- ack
+
+			// as if the ACK had been lost
+			Transmit(udpListener, addr, Message{
+				Type:      Confirmable,
+				Code:      Content,
+				MessageID: 4321,
+				Token:     req.Token,
+				Payload:   []byte("separate"),
+			})
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	m, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 5})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if string(m.Payload) != "separate" {
+		t.Errorf("Expected the separate response, got %q", m.Payload)
+	}
+
+	// the retransmission is acknowledged again even though nobody
+	// waits for the response any more
+	for i := 0; i < 2; i++ {
+		ack := <-acked
+		if ack.Type != Acknowledgement || !ack.IsEmpty() || ack.MessageID != 4321 {
+			t.Errorf("Expected an empty ACK for MessageID 4321, got %v %v %d",
+				ack.Type, ack.Code, ack.MessageID)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(c.incoming); n != 0 {
+		t.Errorf("Expected the retransmission to be dropped, got %d queued", n)
+	}
+}
+
+func TestConnResetsUnknownToken(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	replies := make(chan Message, 2)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		nr, addr, err := udpListener.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, _ := ParseMessage(buf[:nr])
+		Transmit(udpListener, addr, Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: req.MessageID,
+			Token:     req.Token,
+		})
+
+		// a notification of an observation the client forgot, then
+		// its retransmission
+		for i := 0; i < 2; i++ {
+			n := Message{
+				Type:      Confirmable,
+				Code:      Content,
+				MessageID: 999,
+				Token:     []byte("gone"),
+			}
+			n.SetOption(Observe, 7)
+			Transmit(udpListener, addr, n)
+
+			nr, _, err = udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m, _ := ParseMessage(buf[:nr])
+			replies <- m
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+	if _, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 8}); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-replies:
+			if m.Type != Reset || m.MessageID != 999 {
+				t.Errorf("Expected a Reset for MessageID 999, got %v %d", m.Type, m.MessageID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the unknown notification to be rejected")
+		}
+	}
+	if n := len(c.incoming); n != 0 {
+		t.Errorf("Expected nothing queued, got %d", n)
+	}
+}
+
+func TestDoConcurrent(t *testing.T) {
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   m.Payload,
+		}
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf("request %d", i))
+			m, err := c.Do(context.Background(), &Message{
+				Type:    Confirmable,
+				Code:    POST,
+				Payload: payload,
+			})
+			if err != nil {
+				t.Errorf("Error sending request %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(m.Payload, payload) {
+				t.Errorf("Expected payload %q, got %q", payload, m.Payload)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDoCancel(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	c := dialTest(t, coapServerAddr)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Do(ctx, &Message{Type: Confirmable, Code: GET, MessageID: 6, Token: []byte("t")})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	c.Close()
+	_, err = c.Do(context.Background(), &Message{Type: Confirmable, Code: GET, MessageID: 7, Token: []byte("t")})
+	if err == nil {
+		t.Fatalf("Expected an error on a closed connection")
+	}
+}
@@ -0,0 +1,230 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotObservable is returned by Observe when the server does not
+// accept the registration.
+var ErrNotObservable = errors.New("resource is not observable")
+
+const (
+	// DefaultMaxAge is the freshness lifetime of a response that has
+	// no Max-Age option (RFC 7252 section 5.10.5).
+	DefaultMaxAge = 60 * time.Second
+
+	// observeFreshness is the time after which a notification is
+	// taken as newer than the last one whatever its sequence number
+	// (RFC 7641 section 3.4).
+	observeFreshness = 128 * time.Second
+)
+
+// Observation is an observation started with Conn.Observe.
+type Observation struct {
+	c   *Conn
+	req Message
+	f   func(m *Message)
+
+	notes  chan *Message
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu         sync.Mutex
+	ended      bool
+	inCallback bool
+
+	seq uint32
+	at  time.Time
+}
+
+// Observe registers interest in the resource at path (RFC 7641) and
+// calls f with the response and every later notification.  f is
+// called from a single goroutine, in order; notifications older than
+// the last one delivered are discarded.  Confirmable notifications
+// are acknowledged, and the registration is renewed when the last
+// notification's Max-Age runs out.
+//
+// ctx governs the registration request.  If the server answers
+// without registering the client, f is called with the response and
+// ErrNotObservable is returned.
+func (c *Conn) Observe(ctx context.Context, path string, f func(m *Message)) (*Observation, error) {
+	req := Message{Type: Confirmable, Code: GET}
+	req.SetPathString(path)
+	req.SetOption(Observe, ObserveRegister)
+
+	o := &Observation{
+		c:     c,
+		req:   c.prepare(&req),
+		f:     f,
+		notes: make(chan *Message, 16),
+		done:  make(chan struct{}),
+	}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+
+	err := c.registerToken(o.req.Token, o.notes)
+	if err != nil {
+		return nil, err
+	}
+
+	m := o.req
+	rv, err := c.exchange(ctx, &m, o.notes)
+	if err != nil {
+		c.unregisterToken(o.req.Token)
+		return nil, err
+	}
+	f(rv)
+
+	seq, ok := rv.Option(Observe).(uint32)
+	if !ok || !isSuccess(rv.Code) {
+		c.unregisterToken(o.req.Token)
+		return nil, ErrNotObservable
+	}
+	o.seq, o.at = seq, time.Now()
+
+	go o.run(maxAge(rv))
+	return o, nil
+}
+
+// maxAge returns the Max-Age of m.
+func maxAge(m *Message) time.Duration {
+	if v, ok := m.Option(MaxAge).(uint32); ok {
+		return time.Duration(v) * time.Second
+	}
+	return DefaultMaxAge
+}
+
+// fresh reports whether a notification with sequence number v2
+// received at t2 is newer than the last one delivered (RFC 7641
+// section 3.4).
+func (o *Observation) fresh(v2 uint32, t2 time.Time) bool {
+	v1 := o.seq
+	return (v1 < v2 && v2-v1 < 1<<23) ||
+		(v1 > v2 && v1-v2 > 1<<23) ||
+		t2.After(o.at.Add(observeFreshness))
+}
+
+func (o *Observation) run(age time.Duration) {
+	defer close(o.done)
+
+	timer := time.NewTimer(age)
+	defer timer.Stop()
+
+	// call hands m to f unless the observation has been canceled
+	call := func(m *Message) {
+		if o.ctx.Err() != nil {
+			return
+		}
+		o.mu.Lock()
+		o.inCallback = true
+		o.mu.Unlock()
+		o.f(m)
+		o.mu.Lock()
+		o.inCallback = false
+		o.mu.Unlock()
+	}
+
+	// deliver hands m to f and returns false once the server has
+	// ended the observation.
+	deliver := func(m *Message) bool {
+		seq, ok := m.Option(Observe).(uint32)
+		if !ok || !isSuccess(m.Code) {
+			o.mu.Lock()
+			o.ended = true
+			o.mu.Unlock()
+			o.c.unregisterToken(o.req.Token)
+			call(m)
+			return false
+		}
+
+		now := time.Now()
+		if !o.fresh(seq, now) {
+			TraceInfo("[coap] discarding stale notification, Observe: %d", seq)
+			return true
+		}
+		o.seq, o.at = seq, now
+		call(m)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(maxAge(m))
+		return true
+	}
+
+	for {
+		select {
+		case m := <-o.notes:
+			if !deliver(m) {
+				return
+			}
+		case <-timer.C:
+			// Max-Age ran out, renew the registration
+			m := o.req
+			m.MessageID = 0
+			m = o.c.prepare(&m)
+			rv, err := o.c.exchange(o.ctx, &m, o.notes)
+			if err != nil {
+				if o.ctx.Err() != nil {
+					return
+				}
+				TraceInfo("[coap] renewing observation failed: %s", err)
+				timer.Reset(DefaultMaxAge)
+				continue
+			}
+			if !deliver(rv) {
+				return
+			}
+		case <-o.ctx.Done():
+			return
+		case <-o.c.done:
+			return
+		}
+	}
+}
+
+// Done returns a channel that is closed when the observation ends,
+// either because it was canceled or because the server ended it.
+func (o *Observation) Done() <-chan struct{} {
+	return o.done
+}
+
+// Cancel stops delivering notifications and deregisters from the
+// server with a GET carrying Observe 1.  ctx governs the
+// deregistration request.  Cancel may be called from the function
+// the notifications are delivered to.
+func (o *Observation) Cancel(ctx context.Context) error {
+	o.cancel()
+	o.mu.Lock()
+	inCallback := o.inCallback
+	o.mu.Unlock()
+	if !inCallback {
+		// wait for a delivery or renewal in progress
+		<-o.done
+	}
+
+	o.mu.Lock()
+	ended := o.ended
+	o.mu.Unlock()
+	if ended {
+		return nil
+	}
+	defer o.c.unregisterToken(o.req.Token)
+
+	// notifications left in o.notes must not pass for the response
+	resp := make(chan *Message, 1)
+	o.c.rebindToken(o.req.Token, resp)
+
+	m := o.req
+	m.MessageID = 0
+	m.SetOption(Observe, ObserveDeregister)
+	m = o.c.prepare(&m)
+	_, err := o.c.exchange(ctx, &m, resp)
+	return err
+}
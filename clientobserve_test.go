@@ -0,0 +1,300 @@
+package coap
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestObservationFresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		v1, v2 uint32
+		t2     time.Time
+		exp    bool
+	}{
+		{5, 6, now, true},
+		{6, 5, now, false},
+		{5, 5, now, false},
+		{1<<24 - 1, 1, now, true},
+		{1, 1<<24 - 1, now, false},
+		{6, 5, now.Add(observeFreshness + time.Second), true},
+	}
+
+	for _, test := range tests {
+		o := &Observation{seq: test.v1, at: now}
+		if o.fresh(test.v2, test.t2) != test.exp {
+			t.Errorf("Failed on fresh(%d -> %d), wanted %v", test.v1, test.v2, test.exp)
+		}
+	}
+}
+
+func TestObserveClient(t *testing.T) {
+	srv, c, done := startObserveServer(t)
+	defer done()
+
+	payloads := make(chan string, 8)
+	o, err := c.Observe(context.Background(), "/temp", func(m *Message) {
+		payloads <- string(m.Payload)
+	})
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+
+	srv.Notify("/temp")
+	srv.Notify("/temp")
+	for _, exp := range []string{"1", "2", "3"} {
+		select {
+		case p := <-payloads:
+			if p != exp {
+				t.Errorf("Expected notification %q, got %q", exp, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for notification %q", exp)
+		}
+	}
+
+	if err := o.Cancel(context.Background()); err != nil {
+		t.Fatalf("Error canceling: %v", err)
+	}
+	if len(srv.observers.list("temp")) != 0 {
+		t.Errorf("Expected Cancel to deregister the observer")
+	}
+}
+
+func TestObserveClientReorderAndRenew(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	registrations := make(chan Message, 4)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		for {
+			nr, addr, err := udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, _ := ParseMessage(buf[:nr])
+			if req.Type != Confirmable || req.Code != GET {
+				continue
+			}
+			registrations <- req
+
+			res := Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: req.MessageID,
+				Token:     req.Token,
+				Payload:   []byte("5"),
+			}
+			res.SetOption(Observe, 5)
+			res.SetOption(MaxAge, 1)
+			if len(registrations) > 1 {
+				// renewed registration
+				res.SetOption(Observe, 7)
+				res.Payload = []byte("7")
+			}
+			Transmit(udpListener, addr, res)
+
+			for _, seq := range []int{3, 6} {
+				n := Message{
+					Type:    NonConfirmable,
+					Code:    Content,
+					Token:   req.Token,
+					Payload: []byte{byte('0' + seq)},
+				}
+				n.SetOption(Observe, seq)
+				n.SetOption(MaxAge, 1)
+				Transmit(udpListener, addr, n)
+			}
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+
+	payloads := make(chan string, 8)
+	o, err := c.Observe(context.Background(), "/temp", func(m *Message) {
+		payloads <- string(m.Payload)
+	})
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+	defer o.cancel()
+
+	// 3 is older than 5 and must be dropped; after Max-Age the
+	// observation is renewed and 7 arrives, then 6 is stale again
+	for _, exp := range []string{"5", "6", "7"} {
+		select {
+		case p := <-payloads:
+			if p != exp {
+				t.Errorf("Expected notification %q, got %q", exp, p)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Timed out waiting for notification %q", exp)
+		}
+	}
+	if len(registrations) < 2 {
+		t.Errorf("Expected the registration to be renewed")
+	}
+	select {
+	case p := <-payloads:
+		t.Errorf("Expected stale notifications to be dropped, got %q", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestObserveClientCancelPending(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	deregistrations := make(chan int, 4)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		for n := 0; ; {
+			nr, addr, err := udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, _ := ParseMessage(buf[:nr])
+			if req.Type != Confirmable || req.Code != GET {
+				continue
+			}
+			res := Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: req.MessageID,
+				Token:     req.Token,
+			}
+			if req.Option(Observe) == uint32(ObserveRegister) {
+				res.SetOption(Observe, 1)
+				Transmit(udpListener, addr, res)
+				for seq := 2; seq < 8; seq++ {
+					n := Message{Type: NonConfirmable, Code: Content, Token: req.Token}
+					n.SetOption(Observe, seq)
+					Transmit(udpListener, addr, n)
+				}
+				continue
+			}
+			n++
+			deregistrations <- n
+			if n == 1 {
+				// lose the first deregistration
+				continue
+			}
+			Transmit(udpListener, addr, res)
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	// stall delivery so that notifications are still pending when
+	// the observation is canceled
+	stalled := make(chan struct{})
+	unstall := make(chan struct{})
+	calls := 0
+	o, err := c.Observe(context.Background(), "/temp", func(m *Message) {
+		calls++
+		if calls == 2 {
+			close(stalled)
+			<-unstall
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+	<-stalled
+	time.Sleep(20 * time.Millisecond)
+
+	canceled := make(chan error, 1)
+	go func() { canceled <- o.Cancel(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	close(unstall)
+	if err := <-canceled; err != nil {
+		t.Fatalf("Error canceling: %v", err)
+	}
+	if n := len(deregistrations); n != 2 {
+		t.Errorf("Expected the deregistration to be retransmitted, got %d transmissions", n)
+	}
+}
+
+func TestObserveClientCancelFromCallback(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	deregistered := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		for {
+			nr, addr, err := udpListener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, _ := ParseMessage(buf[:nr])
+			if req.Type != Confirmable || req.Code != GET {
+				continue
+			}
+			res := Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: req.MessageID,
+				Token:     req.Token,
+			}
+			if req.Option(Observe) == uint32(ObserveRegister) {
+				res.SetOption(Observe, 1)
+				Transmit(udpListener, addr, res)
+				for seq := 2; seq < 5; seq++ {
+					n := Message{Type: NonConfirmable, Code: Content, Token: req.Token}
+					n.SetOption(Observe, seq)
+					Transmit(udpListener, addr, n)
+				}
+				continue
+			}
+			deregistered <- struct{}{}
+			Transmit(udpListener, addr, res)
+		}
+	}()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+
+	// stop after the second notification from within the callback
+	observation := make(chan *Observation, 1)
+	canceled := make(chan error, 1)
+	calls := 0
+	o, err := c.Observe(context.Background(), "/temp", func(m *Message) {
+		calls++
+		if calls == 3 {
+			canceled <- (<-observation).Cancel(context.Background())
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+	observation <- o
+
+	select {
+	case err := <-canceled:
+		if err != nil {
+			t.Fatalf("Error canceling: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Cancel called from the callback did not return")
+	}
+	select {
+	case <-deregistered:
+	default:
+		t.Errorf("Expected Cancel to deregister")
+	}
+	select {
+	case <-o.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Expected the observation to end")
+	}
+	if calls != 3 {
+		t.Errorf("Expected no notification after Cancel, got %d calls", calls)
+	}
+}
@@ -0,0 +1,86 @@
+package coap
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestMessageCRC32(t *testing.T) {
+	m := Message{Type: Confirmable, Code: POST, MessageID: 1, Payload: []byte("123456789")}
+	if present, _ := m.VerifyCRC32(nil); present {
+		t.Errorf("Expected no CheckCRC32 option")
+	}
+
+	m.SetCRC32(nil)
+	if v := m.Option(CheckCRC32); v != uint32(0xcbf43926) {
+		t.Errorf("Expected IEEE check value 0xcbf43926, got %#v", v)
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if present, valid := parsed.VerifyCRC32(CRC32IEEE); !present || !valid {
+		t.Errorf("Expected a valid CRC32, got present=%v valid=%v", present, valid)
+	}
+	if _, valid := parsed.VerifyCRC32(CRC32Castagnoli); valid {
+		t.Errorf("Expected the Castagnoli CRC32 to differ")
+	}
+
+	m.SetCRC32(CRC32Castagnoli)
+	if v := m.Option(CheckCRC32); v != uint32(0xe3069283) {
+		t.Errorf("Expected Castagnoli check value 0xe3069283, got %#v", v)
+	}
+}
+
+func TestCRC32Handler(t *testing.T) {
+	var calls int32
+	handler := CRC32Handler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteMsg(&Message{Code: Changed})
+	}), CRC32Castagnoli)
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: POST, Payload: []byte("reading")}
+	req.SetPathString("/data")
+
+	// no option, no check
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != Changed {
+		t.Errorf("Expected %v without CRC32, got %v", Changed, m.Code)
+	}
+
+	c.SetCRC32(CRC32Castagnoli)
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != Changed {
+		t.Errorf("Expected %v with a valid CRC32, got %v", Changed, m.Code)
+	}
+
+	c.SetCRC32(CRC32IEEE)
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != GiterlabErrnoDataError {
+		t.Errorf("Expected %v with a wrong CRC32, got %v", CCode(GiterlabErrnoDataError), m.Code)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected the handler to run twice, got %d", n)
+	}
+}
@@ -0,0 +1,70 @@
+package coap
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupCache remembers the requests an endpoint has seen, keyed on
+// remote address and MessageID, together with the response sent for
+// each (RFC 7252 section 4.5).
+type dedupCache struct {
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+	order   []dedupKey
+}
+
+type dedupKey struct {
+	addr string
+	mid  uint16
+}
+
+type dedupEntry struct {
+	expires  time.Time
+	response []byte
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{entries: make(map[dedupKey]*dedupEntry)}
+}
+
+// lookup records key for lifetime and reports whether it was already
+// known.  For a duplicate the cached response is returned; it is nil
+// while the original is still being handled or if it had no response.
+func (c *dedupCache) lookup(key dedupKey, lifetime time.Duration) (response []byte, dup bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		return e.response, true
+	}
+	c.entries[key] = &dedupEntry{expires: now.Add(lifetime)}
+	c.order = append(c.order, key)
+	return nil, false
+}
+
+// respond stores the response sent for key.
+func (c *dedupCache) respond(key dedupKey, response []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.response = response
+	}
+}
+
+func (c *dedupCache) expire(now time.Time) {
+	for len(c.order) > 0 {
+		key := c.order[0]
+		e, ok := c.entries[key]
+		if ok && now.Before(e.expires) {
+			return
+		}
+		if ok {
+			delete(c.entries, key)
+		}
+		c.order = c.order[1:]
+	}
+}
@@ -0,0 +1,104 @@
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrSignalCode is returned when a handler writes a 7.xx code to a
+// peer that reads it as signaling.
+var ErrSignalCode = errors.New("code is reserved for signaling")
+
+// Dialect decides how an endpoint reads the codes of classes 6 and 7,
+// which the GiterLab errnos share with the signaling codes of RFC 8323:
+// GiterlabErrnoDataError and CSM, for instance, are both 225.
+type Dialect uint8
+
+const (
+	// DialectAuto reads 7.xx codes as signaling on transports that
+	// carry it, RFC 8323 streams, and as GiterLab errnos elsewhere.
+	DialectAuto Dialect = iota
+	// DialectGiterLab reads 6.xx and 7.xx codes as GiterLab errnos.
+	// Streams in this dialect exchange no signaling messages.
+	DialectGiterLab
+	// DialectRFC reads 7.xx codes as signaling and leaves class 6
+	// unassigned.  Handlers may not answer with 7.xx codes.
+	DialectRFC
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectAuto:
+		return "Auto"
+	case DialectGiterLab:
+		return "GiterLab"
+	case DialectRFC:
+		return "RFC"
+	}
+	return fmt.Sprintf("Dialect(%d)", uint8(d))
+}
+
+// resolve picks the dialect of an endpoint whose transport can carry
+// signaling or not.
+func (d Dialect) resolve(signaling bool) Dialect {
+	if d != DialectAuto {
+		return d
+	}
+	if signaling {
+		return DialectRFC
+	}
+	return DialectGiterLab
+}
+
+// rfcCodeNames holds the names of the codes that DialectRFC reads
+// differently.
+var rfcCodeNames = map[CCode]string{
+	CSM:     "CSM",
+	Ping:    "Ping",
+	Pong:    "Pong",
+	Release: "Release",
+	Abort:   "Abort",
+}
+
+// codeDialect holds the Dialect CCode.String names codes in.  It is
+// accessed atomically as String may run on any goroutine.
+var codeDialect = uint32(DialectGiterLab)
+
+// SetCodeDialect sets the dialect CCode.String names 6.xx and 7.xx
+// codes in, DialectGiterLab by default.  DialectAuto restores the
+// default.  It is safe to call while codes are being formatted.
+// Servers and connections log the codes they exchange in their own
+// dialect regardless.
+func SetCodeDialect(d Dialect) {
+	atomic.StoreUint32(&codeDialect, uint32(d.resolve(false)))
+}
+
+// currentCodeDialect returns the dialect set by SetCodeDialect.
+func currentCodeDialect() Dialect {
+	return Dialect(atomic.LoadUint32(&codeDialect))
+}
+
+// CodeString names c as the dialect reads it.
+func (d Dialect) CodeString(c CCode) string {
+	if d != DialectRFC || c>>5 < 6 {
+		return codeNames[c]
+	}
+	if name, ok := rfcCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%x)", uint8(c))
+}
+
+// IsSignal reports whether the dialect reads c as a signaling code.
+func (d Dialect) IsSignal(c CCode) bool {
+	return d == DialectRFC && isSignal(c)
+}
+
+// checkCode rejects the codes a handler may not write in dialect d.
+func checkCode(d Dialect, c CCode) error {
+	if d.IsSignal(c) {
+		return ErrSignalCode
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package coap
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDialectCodeString(t *testing.T) {
+	tests := []struct {
+		d   Dialect
+		c   CCode
+		exp string
+	}{
+		{DialectGiterLab, GiterlabErrnoDataError, "GiterlabErrnoDataError"},
+		{DialectRFC, GiterlabErrnoDataError, "CSM"},
+		{DialectRFC, Abort, "Abort"},
+		{DialectRFC, GiterlabErrnoRequestTimeout, "Unknown (0xe6)"},
+		{DialectRFC, GiterlabErrnoOk, "Unknown (0xc0)"},
+		{DialectRFC, Content, "Content"},
+		{DialectAuto, Ping, "GiterlabErrnoDeviceNotExist"},
+	}
+	for _, test := range tests {
+		if got := test.d.CodeString(test.c); got != test.exp {
+			t.Errorf("%v: expected %q for %d, got %q", test.d, test.exp, uint8(test.c), got)
+		}
+	}
+
+	if !DialectRFC.IsSignal(CSM) || DialectGiterLab.IsSignal(CSM) {
+		t.Errorf("Only DialectRFC should read 7.01 as signaling")
+	}
+}
+
+func TestSetCodeDialect(t *testing.T) {
+	defer SetCodeDialect(DialectAuto)
+
+	if got := fmt.Sprintf("%v", CSM); got != "GiterlabErrnoDataError" {
+		t.Errorf("Expected GiterLab names by default, got %q", got)
+	}
+	SetCodeDialect(DialectRFC)
+	if got := fmt.Sprintf("%v", CSM); got != "CSM" {
+		t.Errorf("Expected %q, got %q", "CSM", got)
+	}
+	if got := Content.String(); got != "Content" {
+		t.Errorf("Expected %q, got %q", "Content", got)
+	}
+	SetCodeDialect(DialectAuto)
+	if got := CSM.String(); got != "GiterlabErrnoDataError" {
+		t.Errorf("Expected DialectAuto to restore the default, got %q", got)
+	}
+}
+
+func TestSetCodeDialectConcurrent(t *testing.T) {
+	defer SetCodeDialect(DialectAuto)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = CSM.String()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		SetCodeDialect(DialectRFC)
+		SetCodeDialect(DialectGiterLab)
+	}
+	<-done
+}
+
+func TestServeTCPDialect(t *testing.T) {
+	errc := make(chan error, 1)
+	mux := NewServeMux()
+	mux.Handle("/data", HandlerFunc(func(w ResponseWriter, r *Request) {
+		errc <- w.WriteMsg(&Message{Code: GiterlabErrnoDataError})
+	}))
+
+	// GiterLab devices read 7.01 as an errno and exchange no CSM
+	srv := &Server{Handler: mux, Dialect: DialectGiterLab}
+	defer srv.Close()
+	addr := startTCPServer(t, srv)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	c, err := NewTCPConn(nc, FramingRFC8323, DialectGiterLab)
+	if err != nil {
+		t.Fatalf("Error starting client: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Code: POST}
+	req.SetPathString("/data")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != GiterlabErrnoDataError {
+		t.Errorf("Expected %v, got %v", GiterlabErrnoDataError, rv.Code)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Error writing response: %v", err)
+	}
+
+	// standard peers read it as a CSM, which handlers may not send
+	srv2 := &Server{Handler: mux}
+	defer srv2.Close()
+	c2, err := DialTCP("tcp", startTCPServer(t, srv2))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c2.Close()
+
+	go c2.Send(req)
+	if err := <-errc; err != ErrSignalCode {
+		t.Errorf("Expected %v, got %v", ErrSignalCode, err)
+	}
+}
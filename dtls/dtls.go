@@ -0,0 +1,323 @@
+// Package dtls runs CoAP over DTLS 1.2 (coaps://, RFC 7252 section 9)
+// with pre-shared keys or certificates.
+//
+// A Listener is a net.PacketConn that a coap.Server serves like a UDP
+// socket; Dial returns a coap.Conn whose messages travel in a DTLS
+// session.  Handlers find out who the client authenticated as with
+// PSKIdentity and PeerCertificates.
+package dtls
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	coap "github.com/GiterLab/go-coap"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v2/udp"
+)
+
+// DefaultAddr is the address ListenAndServe listens on when addr is
+// empty.
+const DefaultAddr = ":5684"
+
+// maxPktLen is the largest CoAP message read from a session.
+const maxPktLen = 1500
+
+// errNoSession is returned when writing to a peer without a session.
+var errNoSession = errors.New("no dtls session with peer")
+
+// Config configures the DTLS layer: PSK or PSKIdentityHint for
+// pre-shared keys, Certificates and ClientAuth for certificates.
+type Config = dtls.Config
+
+// Addr is the address of a DTLS peer together with what it
+// authenticated with.
+type Addr struct {
+	// Addr is the UDP address of the peer.
+	net.Addr
+	// PSKIdentity is the identity the client sent in PSK mode.
+	PSKIdentity []byte
+	// PeerCertificates are the DER encoded certificates the peer
+	// presented in certificate mode.
+	PeerCertificates [][]byte
+}
+
+// Network returns "dtls".
+func (a *Addr) Network() string {
+	return "dtls"
+}
+
+// PSKIdentity returns the PSK identity the client of r authenticated
+// with, if r arrived over DTLS in PSK mode.
+func PSKIdentity(r *coap.Request) ([]byte, bool) {
+	a, ok := r.RemoteAddr.(*Addr)
+	if !ok || a.PSKIdentity == nil {
+		return nil, false
+	}
+	return a.PSKIdentity, true
+}
+
+// PeerCertificates returns the DER encoded certificates the client of
+// r presented, if r arrived over DTLS in certificate mode.
+func PeerCertificates(r *coap.Request) [][]byte {
+	a, ok := r.RemoteAddr.(*Addr)
+	if !ok {
+		return nil
+	}
+	return a.PeerCertificates
+}
+
+// packet is a message read from a session.
+type packet struct {
+	data []byte
+	addr *Addr
+}
+
+// Listener accepts DTLS sessions on a UDP port and presents their
+// messages as a single net.PacketConn.
+type Listener struct {
+	parent  net.Listener
+	config  *Config
+	packets chan packet
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*dtls.Conn
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// Listen listens for DTLS sessions on the UDP address addr.
+func Listen(network, addr string, config *Config) (*Listener, error) {
+	uaddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := udp.ListenConfig{
+		// only handshakes open new sessions
+		AcceptFilter: func(data []byte) bool {
+			pkts, err := recordlayer.UnpackDatagram(data)
+			if err != nil || len(pkts) < 1 {
+				return false
+			}
+			h := &recordlayer.Header{}
+			if err := h.Unmarshal(pkts[0]); err != nil {
+				return false
+			}
+			return h.ContentType == protocol.ContentTypeHandshake
+		},
+	}
+	parent, err := lc.Listen(network, uaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		parent:   parent,
+		config:   config,
+		packets:  make(chan packet),
+		closed:   make(chan struct{}),
+		sessions: make(map[string]*dtls.Conn),
+		wake:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.parent.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			coap.TraceInfo("[coap] dtls accept error: %s", err)
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		go l.serve(c)
+	}
+}
+
+// serve completes the handshake of a new session and reads its
+// messages until it is closed.
+func (l *Listener) serve(c net.Conn) {
+	dc, err := dtls.Server(c, l.config)
+	if err != nil {
+		coap.TraceInfo("[coap] Remote: %v, dtls handshake failed: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	state := dc.ConnectionState()
+	addr := &Addr{
+		Addr:             dc.RemoteAddr(),
+		PSKIdentity:      state.IdentityHint,
+		PeerCertificates: state.PeerCertificates,
+	}
+	key := addr.String()
+
+	l.mu.Lock()
+	if old := l.sessions[key]; old != nil {
+		old.Close()
+	}
+	l.sessions[key] = dc
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		if l.sessions[key] == dc {
+			delete(l.sessions, key)
+		}
+		l.mu.Unlock()
+		dc.Close()
+	}()
+
+	buf := make([]byte, maxPktLen)
+	for {
+		n, err := dc.Read(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf)
+
+		select {
+		case l.packets <- packet{data, addr}:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// ReadFrom reads the next message of any session.  The address
+// returned is an *Addr.
+func (l *Listener) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, again, err := l.readFrom(p)
+		if !again {
+			return n, addr, err
+		}
+	}
+}
+
+// readFrom waits for the next message until the current deadline.  It
+// reports again when the deadline changed in the meantime.
+func (l *Listener) readFrom(p []byte) (n int, addr net.Addr, again bool, err error) {
+	l.mu.Lock()
+	deadline, wake := l.deadline, l.wake
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, false, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case pkt := <-l.packets:
+		return copy(p, pkt.data), pkt.addr, false, nil
+	case <-l.closed:
+		return 0, nil, false, net.ErrClosed
+	case <-timeout:
+		return 0, nil, false, os.ErrDeadlineExceeded
+	case <-wake:
+		return 0, nil, true, nil
+	}
+}
+
+// WriteTo sends p in the session with addr.
+func (l *Listener) WriteTo(p []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	dc := l.sessions[addr.String()]
+	l.mu.Unlock()
+
+	if dc == nil {
+		return 0, &net.OpError{Op: "write", Net: "dtls", Addr: addr, Err: errNoSession}
+	}
+	return dc.Write(p)
+}
+
+// Close stops accepting sessions and closes the open ones.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.parent.Close()
+
+		l.mu.Lock()
+		for key, dc := range l.sessions {
+			dc.Close()
+			delete(l.sessions, key)
+		}
+		l.mu.Unlock()
+	})
+	return err
+}
+
+// LocalAddr returns the listener's address; its network is "dtls".
+func (l *Listener) LocalAddr() net.Addr {
+	return &Addr{Addr: l.parent.Addr()}
+}
+
+// SetDeadline sets the read deadline.
+func (l *Listener) SetDeadline(t time.Time) error {
+	return l.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for ReadFrom.
+func (l *Listener) SetReadDeadline(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deadline = t
+	close(l.wake)
+	l.wake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op; writes to a session do not block.
+func (l *Listener) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Dial connects a CoAP client to addr over DTLS.
+func Dial(network, addr string, config *Config) (*coap.Conn, error) {
+	uaddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dc, err := dtls.Dial(network, uaddr, config)
+	if err != nil {
+		return nil, err
+	}
+	return coap.NewConn(dc), nil
+}
+
+// ListenAndServe listens for DTLS sessions on the UDP address addr,
+// DefaultAddr if empty, and serves requests forever.
+func ListenAndServe(addr string, config *Config, h coap.Handler) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	l, err := Listen("udp", addr, config)
+	if err != nil {
+		return err
+	}
+	server := &coap.Server{Handler: h}
+	return server.ServePacket(l)
+}
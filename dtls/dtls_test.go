@@ -0,0 +1,121 @@
+package dtls
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	coap "github.com/GiterLab/go-coap"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+func startServer(t *testing.T, config *Config, h coap.Handler) (*coap.Server, string) {
+	l, err := Listen("udp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	srv := &coap.Server{Handler: h}
+	go srv.ServePacket(l)
+	return srv, l.LocalAddr().String()
+}
+
+func TestPSK(t *testing.T) {
+	key := []byte{0x0c, 0x0a, 0x0f, 0x0e}
+	identities := make(chan string, 1)
+	handler := coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		if r.Transport != coap.TransportDTLS {
+			t.Errorf("Expected transport %v, got %v", coap.TransportDTLS, r.Transport)
+		}
+		id, _ := PSKIdentity(r)
+		identities <- string(id)
+		w.WriteMsg(&coap.Message{Code: coap.Content, Payload: []byte("psk")})
+	})
+	srv, addr := startServer(t, &Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			if string(hint) != "device-1" {
+				t.Errorf("Unexpected identity %q", hint)
+			}
+			return key, nil
+		},
+		PSKIdentityHint: []byte("server"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}, handler)
+	defer srv.Close()
+
+	c, err := Dial("udp", addr, &Config{
+		PSK:             func([]byte) ([]byte, error) { return key, nil },
+		PSKIdentityHint: []byte("device-1"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		m, err := c.Send(coap.Message{Type: coap.Confirmable, Code: coap.GET})
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		if m.Type != coap.Acknowledgement || string(m.Payload) != "psk" {
+			t.Errorf("Expected a piggybacked psk response, got %v %q", m.Type, m.Payload)
+		}
+		if id := <-identities; id != "device-1" {
+			t.Errorf("Expected identity device-1, got %q", id)
+		}
+	}
+}
+
+func TestCertificate(t *testing.T) {
+	serverCert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("Error generating certificate: %v", err)
+	}
+	clientCert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("Error generating certificate: %v", err)
+	}
+
+	peers := make(chan int, 1)
+	handler := coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		peers <- len(PeerCertificates(r))
+		w.WriteMsg(&coap.Message{Code: coap.Content, Payload: []byte("cert")})
+	})
+	srv, addr := startServer(t, &Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   dtls.RequireAnyClientCert,
+	}, handler)
+
+	c, err := Dial("udp", addr, &Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	m, err := c.Send(coap.Message{Type: coap.Confirmable, Code: coap.GET})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if string(m.Payload) != "cert" {
+		t.Errorf("Expected payload cert, got %q", m.Payload)
+	}
+	if n := <-peers; n != 1 {
+		t.Errorf("Expected the client certificate, got %d", n)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error shutting down: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Shutdown did not stop reading from the listener")
+	}
+}
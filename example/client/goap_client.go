@@ -10,10 +10,9 @@ import (
 func main() {
 
 	req := coap.Message{
-		Type:      coap.Confirmable,
-		Code:      coap.GET,
-		MessageID: 12345,
-		Payload:   []byte("hello, world!"),
+		Type:    coap.Confirmable,
+		Code:    coap.GET,
+		Payload: []byte("hello, world!"),
 	}
 
 	path := "/some/path"
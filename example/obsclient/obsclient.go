@@ -1,41 +1,36 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
 
 	"github.com/GiterLab/go-coap"
 )
 
 func main() {
-
-	req := coap.Message{
-		Type:      coap.NonConfirmable,
-		Code:      coap.GET,
-		MessageID: 12345,
-	}
-
-	req.AddOption(coap.Observe, 1)
-	req.SetPathString("/some/path")
-
 	c, err := coap.Dial("udp", "localhost:5683")
 	if err != nil {
 		log.Fatalf("Error dialing: %v", err)
 	}
+	defer c.Close()
 
-	rv, err := c.Send(req)
+	obs, err := c.Observe(context.Background(), "/some/path", func(m *coap.Message) {
+		log.Printf("Got %s", m.Payload)
+	})
 	if err != nil {
-		log.Fatalf("Error sending request: %v", err)
+		log.Fatalf("Error observing: %v", err)
 	}
 
-	for err == nil {
-		if rv != nil {
-			if err != nil {
-				log.Fatalf("Error receiving: %v", err)
-			}
-			log.Printf("Got %s", rv.Payload)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	select {
+	case <-interrupt:
+		if err := obs.Cancel(context.Background()); err != nil {
+			log.Printf("Error canceling: %v", err)
 		}
-		rv, err = c.Receive()
-
+	case <-obs.Done():
 	}
 	log.Printf("Done...\n")
 }
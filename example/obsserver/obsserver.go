@@ -3,47 +3,31 @@ package main
 import (
 	"fmt"
 	"log"
-	"net"
 	"time"
 
 	"github.com/GiterLab/go-coap"
 )
 
-func periodicTransmitter(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) {
-	subded := time.Now()
-
-	for {
-		msg := coap.Message{
-			Type:      coap.Acknowledgement,
-			Code:      coap.Content,
-			MessageID: m.MessageID,
-			Payload:   []byte(fmt.Sprintf("Been running for %v", time.Since(subded))),
-		}
+func main() {
+	started := time.Now()
 
-		msg.SetOption(coap.ContentFormat, coap.TextPlain)
-		msg.SetOption(coap.LocationPath, m.Path())
+	mux := coap.NewServeMux()
+	mux.Handle("/some/path", coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		log.Printf("Got message path=%q: %#v from %v", r.Msg.Path(), r.Msg, r.RemoteAddr)
 
-		log.Printf("Transmitting %v", msg)
-		err := coap.Transmit(l, a, msg)
-		if err != nil {
-			log.Printf("Error on transmitter, stopping: %v", err)
-			return
+		res := &coap.Message{
+			Code:    coap.Content,
+			Payload: []byte(fmt.Sprintf("Been running for %v", time.Since(started))),
 		}
-
-		time.Sleep(time.Second)
-	}
-}
-
-func main() {
-	log.Fatal(coap.ListenAndServe("udp", ":5683",
-		coap.FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
-			log.Printf("Got message path=%q: %#v from %v", m.Path(), m, a)
-			if m.Code == coap.GET && m.Option(coap.Observe) != nil {
-				if value, ok := m.Option(coap.Observe).([]uint8); ok &&
-					len(value) >= 1 && value[0] == 1 {
-					go periodicTransmitter(l, a, m)
-				}
-			}
-			return nil
-		})))
+		res.SetOption(coap.ContentFormat, coap.TextPlain)
+		w.WriteMsg(res)
+	}))
+
+	srv := &coap.Server{Addr: ":5683", Handler: mux}
+	go func() {
+		for range time.Tick(time.Second) {
+			srv.Notify("/some/path")
+		}
+	}()
+	log.Fatal(srv.ListenAndServe())
 }
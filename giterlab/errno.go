@@ -0,0 +1,102 @@
+package giterlab
+
+import (
+	"fmt"
+
+	coap "github.com/GiterLab/go-coap"
+)
+
+// Error is a GiterLab errno, or another error code, answered by the
+// platform.
+type Error struct {
+	Code coap.CCode
+}
+
+func (e *Error) Error() string {
+	if msg, ok := errnoMessages[e.Code]; ok {
+		return "giterlab: " + msg
+	}
+	return fmt.Sprintf("giterlab: error response %s", coap.DialectGiterLab.CodeString(e.Code))
+}
+
+// Is makes errors.Is match Errors by code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Errors for the GiterLab errnos.
+var (
+	ErrIllegalKey                  = &Error{coap.GiterlabErrnoIllegalKey}
+	ErrDataError                   = &Error{coap.GiterlabErrnoDataError}
+	ErrDeviceNotExist              = &Error{coap.GiterlabErrnoDeviceNotExist}
+	ErrTimeExpired                 = &Error{coap.GiterlabErrnoTimeExpired}
+	ErrNotSupportProtocolVersion   = &Error{coap.GiterlabErrnoNotSupportProtocolVersion}
+	ErrProtocolParsingErrors       = &Error{coap.GiterlabErrnoProtocolParsingErrors}
+	ErrRequestTimeout              = &Error{coap.GiterlabErrnoRequestTimeout}
+	ErrOptProtocolParsingErrors    = &Error{coap.GiterlabErrnoOptProtocolParsingErrors}
+	ErrNotSupportAnalyticalMethods = &Error{coap.GiterlabErrnoNotSupportAnalyticalMethods}
+	ErrNotSupportPacketType        = &Error{coap.GiterlabErrnoNotSupportPacketType}
+	ErrDataDecodingError           = &Error{coap.GiterlabErrnoDataDecodingError}
+	ErrPackageLengthError          = &Error{coap.GiterlabErrnoPackageLengthError}
+	ErrDuoxieyunServerRequestBusy  = &Error{coap.GiterlabErrnoDuoxieyunServerRequestBusy}
+	ErrSluanServerRequestBusy      = &Error{coap.GiterlabErrnoSluanServerRequestBusy}
+	ErrCacheServiceErrors          = &Error{coap.GiterlabErrnoCacheServiceErrors}
+	ErrTableStoreServiceErrors     = &Error{coap.GiterlabErrnoTableStoreServiceErrors}
+	ErrDatabaseServiceErrors       = &Error{coap.GiterlabErrnoDatabaseServiceErrors}
+	ErrNotSupportEncodingType      = &Error{coap.GiterlabErrnoNotSupportEncodingType}
+	ErrDeviceRepeatRegistered      = &Error{coap.GiterlabErrnoDeviceRepeatRegistered}
+	ErrDeviceSimCardUsed           = &Error{coap.GiterlabErrnoDeviceSimCardUsed}
+	ErrDeviceSimCardIllegal        = &Error{coap.GiterlabErrnoDeviceSimCardIllegal}
+	ErrDeviceUpdateForcedFailed    = &Error{coap.GiterlabErrnoDeviceUpdateForcedFailed}
+)
+
+var errnoMessages = map[coap.CCode]string{
+	coap.GiterlabErrnoIllegalKey:                  "illegal key",
+	coap.GiterlabErrnoDataError:                   "data error",
+	coap.GiterlabErrnoDeviceNotExist:              "device does not exist or sensor type mismatch",
+	coap.GiterlabErrnoTimeExpired:                 "time expired",
+	coap.GiterlabErrnoNotSupportProtocolVersion:   "protocol version not supported",
+	coap.GiterlabErrnoProtocolParsingErrors:       "protocol parsing error",
+	coap.GiterlabErrnoRequestTimeout:              "request timeout",
+	coap.GiterlabErrnoOptProtocolParsingErrors:    "optional header parsing error",
+	coap.GiterlabErrnoNotSupportAnalyticalMethods: "optional header parsing method not supported",
+	coap.GiterlabErrnoNotSupportPacketType:        "packet type not supported",
+	coap.GiterlabErrnoDataDecodingError:           "data decoding error",
+	coap.GiterlabErrnoPackageLengthError:          "package length error",
+	coap.GiterlabErrnoDuoxieyunServerRequestBusy:  "duoxieyun server request failed",
+	coap.GiterlabErrnoSluanServerRequestBusy:      "sluan server request failed",
+	coap.GiterlabErrnoCacheServiceErrors:          "cache service error",
+	coap.GiterlabErrnoTableStoreServiceErrors:     "table store service error",
+	coap.GiterlabErrnoDatabaseServiceErrors:       "database service error",
+	coap.GiterlabErrnoNotSupportEncodingType:      "encoding type not supported",
+	coap.GiterlabErrnoDeviceRepeatRegistered:      "device registered twice",
+	coap.GiterlabErrnoDeviceSimCardUsed:           "SIM card already in use",
+	coap.GiterlabErrnoDeviceSimCardIllegal:        "SIM card not registered",
+	coap.GiterlabErrnoDeviceUpdateForcedFailed:    "forced device update failed",
+}
+
+// IsSuccess reports whether c answers a request successfully: a 2.xx
+// code or one of the 6.xx errnos, which tell the device what to do
+// next.
+func IsSuccess(c coap.CCode) bool {
+	return c>>5 == 2 || c>>5 == 6
+}
+
+// ErrorFor returns the error answered with code c, nil if c is a
+// success.  errors.Is matches it with the Err variable of its errno.
+func ErrorFor(c coap.CCode) error {
+	if IsSuccess(c) {
+		return nil
+	}
+	return &Error{c}
+}
+
+// ErrorCode returns the errno to answer err with:
+// GiterlabErrnoProtocolParsingErrors unless err is an *Error.
+func ErrorCode(err error) coap.CCode {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return coap.GiterlabErrnoProtocolParsingErrors
+}
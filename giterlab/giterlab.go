@@ -0,0 +1,242 @@
+// Package giterlab maps the GiterLab device protocol onto CoAP
+// messages.
+//
+// Devices identify themselves with private options: AccessID and
+// AccessKey in protocol version 1, GiterLabID and GiterLabKey in
+// version 2.  The platform answers with the 6.xx and 7.xx GiterLab
+// errnos, so endpoints carrying this protocol over RFC 8323 streams
+// must use coap.DialectGiterLab.
+package giterlab
+
+import (
+	"fmt"
+
+	coap "github.com/GiterLab/go-coap"
+)
+
+// Version is a GiterLab protocol version.
+type Version uint8
+
+// Protocol versions.
+const (
+	PV1 Version = 1
+	PV2 Version = 2
+)
+
+func (v Version) String() string {
+	return fmt.Sprintf("PV%d", uint8(v))
+}
+
+// requiredOptions lists the options a request must carry in each
+// protocol version.
+var requiredOptions = map[Version][]coap.OptionID{
+	PV1: {coap.AccessID, coap.AccessKey},
+	PV2: {coap.GiterLabID, coap.GiterLabKey},
+}
+
+// pv2Codes are the errnos introduced by protocol version 2.
+var pv2Codes = map[coap.CCode]bool{
+	coap.GiterlabErrnoParamConfigure:           true,
+	coap.GiterlabErrnoFirmwareUpdate:           true,
+	coap.GiterlabErrnoUserCommand:              true,
+	coap.GiterlabErrnoEnterFlightMode:          true,
+	coap.GiterlabErrnoDeviceRepeatRegistered:   true,
+	coap.GiterlabErrnoDeviceSimCardUsed:        true,
+	coap.GiterlabErrnoDeviceSimCardIllegal:     true,
+	coap.GiterlabErrnoDeviceUpdateForcedFailed: true,
+}
+
+// DeviceRequest is a request of a GiterLab device.
+type DeviceRequest struct {
+	Version Version
+	Type    coap.CType
+	Code    coap.CCode
+	// Path is the URI path, without leading slash when parsed.
+	Path string
+
+	// ID and Key authenticate the device: AccessID and AccessKey
+	// in PV1, GiterLabID and GiterLabKey in PV2.
+	ID  string
+	Key string
+
+	// HasCRC32 tells whether CRC32 is set.
+	HasCRC32      bool
+	CRC32         uint32
+	EncoderType   uint32
+	EncoderID     uint32
+	Flags         uint32
+	PackageNumber uint32
+
+	Payload []byte
+}
+
+// idOptions returns the options carrying the device's ID and key in
+// version v.
+func idOptions(v Version) (id, key coap.OptionID, err error) {
+	switch v {
+	case PV1:
+		return coap.AccessID, coap.AccessKey, nil
+	case PV2:
+		return coap.GiterLabID, coap.GiterLabKey, nil
+	}
+	return 0, 0, ErrNotSupportProtocolVersion
+}
+
+// Message builds the CoAP message of r.  The MessageID and Token are
+// left for the client to fill in.
+func (r *DeviceRequest) Message() (coap.Message, error) {
+	idOpt, keyOpt, err := idOptions(r.Version)
+	if err != nil {
+		return coap.Message{}, err
+	}
+
+	m := coap.Message{Type: r.Type, Code: r.Code, Payload: r.Payload}
+	if r.Path != "" {
+		m.SetPathString(r.Path)
+	}
+	if r.ID != "" {
+		m.SetOption(idOpt, r.ID)
+	}
+	if r.Key != "" {
+		m.SetOption(keyOpt, r.Key)
+	}
+	if r.HasCRC32 {
+		m.SetOption(coap.CheckCRC32, r.CRC32)
+	}
+	setUint(&m, coap.EncoderType, r.EncoderType)
+	setUint(&m, coap.EncoderID, r.EncoderID)
+	setUint(&m, coap.Flags, r.Flags)
+	setUint(&m, coap.PackageNumber, r.PackageNumber)
+
+	if err := Validate(&m, r.Version); err != nil {
+		return coap.Message{}, err
+	}
+	return m, nil
+}
+
+func setUint(m *coap.Message, o coap.OptionID, v uint32) {
+	if v != 0 {
+		m.SetOption(o, v)
+	}
+}
+
+func optionUint(m *coap.Message, o coap.OptionID) uint32 {
+	v, _ := m.Option(o).(uint32)
+	return v
+}
+
+func optionString(m *coap.Message, o coap.OptionID) string {
+	v, _ := m.Option(o).(string)
+	return v
+}
+
+// VersionOf tells the protocol version of a device request by the
+// options identifying the device.
+func VersionOf(m *coap.Message) (Version, error) {
+	switch {
+	case m.Option(coap.GiterLabID) != nil:
+		return PV2, nil
+	case m.Option(coap.AccessID) != nil:
+		return PV1, nil
+	}
+	return 0, ErrNotSupportProtocolVersion
+}
+
+// Validate checks that m carries the options version v requires.
+// Missing options are reported as ErrOptProtocolParsingErrors.
+func Validate(m *coap.Message, v Version) error {
+	opts, ok := requiredOptions[v]
+	if !ok {
+		return ErrNotSupportProtocolVersion
+	}
+	for _, o := range opts {
+		if m.Option(o) == nil {
+			return ErrOptProtocolParsingErrors
+		}
+	}
+	return nil
+}
+
+// ParseRequest reads a device request from m.  Errors are *Error
+// values; answer them with ErrorCode.
+func ParseRequest(m *coap.Message) (*DeviceRequest, error) {
+	v, err := VersionOf(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := Validate(m, v); err != nil {
+		return nil, err
+	}
+	idOpt, keyOpt, _ := idOptions(v)
+
+	r := &DeviceRequest{
+		Version:       v,
+		Type:          m.Type,
+		Code:          m.Code,
+		Path:          m.PathString(),
+		ID:            optionString(m, idOpt),
+		Key:           optionString(m, keyOpt),
+		EncoderType:   optionUint(m, coap.EncoderType),
+		EncoderID:     optionUint(m, coap.EncoderID),
+		Flags:         optionUint(m, coap.Flags),
+		PackageNumber: optionUint(m, coap.PackageNumber),
+		Payload:       m.Payload,
+	}
+	if crc, ok := m.Option(coap.CheckCRC32).(uint32); ok {
+		r.HasCRC32, r.CRC32 = true, crc
+	}
+	return r, nil
+}
+
+// NoAck tells whether the device asked for no response with
+// coap.FlagNoAck.
+func (r *DeviceRequest) NoAck() bool {
+	return coap.FlagIsNoAck(r.Flags)
+}
+
+// DeviceResponse is the platform's answer to a device request.
+type DeviceResponse struct {
+	Code          coap.CCode
+	Flags         uint32
+	PackageNumber uint32
+	Payload       []byte
+}
+
+// Message builds the CoAP message of r.  Type, MessageID and Token are
+// left for the server to fill in.
+func (r *DeviceResponse) Message() coap.Message {
+	m := coap.Message{Code: r.Code, Payload: r.Payload}
+	setUint(&m, coap.Flags, r.Flags)
+	setUint(&m, coap.PackageNumber, r.PackageNumber)
+	return m
+}
+
+// Err returns the error r answers with, nil on success.
+func (r *DeviceResponse) Err() error {
+	return ErrorFor(r.Code)
+}
+
+// ErrorResponse builds the response answering a request with err.
+func ErrorResponse(err error) *DeviceResponse {
+	return &DeviceResponse{Code: ErrorCode(err)}
+}
+
+// ParseResponse reads the answer to a request of version v from m.
+// The response is returned together with its error, if any.  Errnos
+// that v does not know fail with ErrNotSupportProtocolVersion.
+func ParseResponse(m *coap.Message, v Version) (*DeviceResponse, error) {
+	if _, ok := requiredOptions[v]; !ok {
+		return nil, ErrNotSupportProtocolVersion
+	}
+	if v < PV2 && pv2Codes[m.Code] {
+		return nil, ErrNotSupportProtocolVersion
+	}
+
+	r := &DeviceResponse{
+		Code:          m.Code,
+		Flags:         optionUint(m, coap.Flags),
+		PackageNumber: optionUint(m, coap.PackageNumber),
+		Payload:       m.Payload,
+	}
+	return r, r.Err()
+}
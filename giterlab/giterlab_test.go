@@ -0,0 +1,108 @@
+package giterlab
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	coap "github.com/GiterLab/go-coap"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, v := range []Version{PV1, PV2} {
+		req := &DeviceRequest{
+			Version:       v,
+			Type:          coap.Confirmable,
+			Code:          coap.POST,
+			Path:          "data",
+			ID:            "device-1",
+			Key:           "secret",
+			HasCRC32:      true,
+			CRC32:         0xcbf43926,
+			EncoderType:   2,
+			EncoderID:     7,
+			Flags:         coap.FlagNoAck,
+			PackageNumber: 3,
+			Payload:       []byte("hi"),
+		}
+		m, err := req.Message()
+		if err != nil {
+			t.Fatalf("%v: error building message: %v", v, err)
+		}
+
+		d, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%v: error encoding: %v", v, err)
+		}
+		parsed, err := coap.ParseMessage(d)
+		if err != nil {
+			t.Fatalf("%v: error decoding: %v", v, err)
+		}
+		got, err := ParseRequest(&parsed)
+		if err != nil {
+			t.Fatalf("%v: error parsing request: %v", v, err)
+		}
+		if !reflect.DeepEqual(got, req) {
+			t.Errorf("%v: expected %#v, got %#v", v, req, got)
+		}
+		if !got.NoAck() {
+			t.Errorf("%v: expected NoAck", v)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	req := &DeviceRequest{Version: PV2, Code: coap.POST, ID: "device-1"}
+	if _, err := req.Message(); err != ErrOptProtocolParsingErrors {
+		t.Errorf("Expected %v without key, got %v", ErrOptProtocolParsingErrors, err)
+	}
+	req = &DeviceRequest{Version: 3, Code: coap.POST, ID: "device-1", Key: "k"}
+	if _, err := req.Message(); err != ErrNotSupportProtocolVersion {
+		t.Errorf("Expected %v, got %v", ErrNotSupportProtocolVersion, err)
+	}
+
+	m := coap.Message{Code: coap.POST}
+	if _, err := ParseRequest(&m); err != ErrNotSupportProtocolVersion {
+		t.Errorf("Expected %v without identity, got %v", ErrNotSupportProtocolVersion, err)
+	}
+	m.SetOption(coap.AccessID, "device-1")
+	_, err := ParseRequest(&m)
+	if err != ErrOptProtocolParsingErrors {
+		t.Errorf("Expected %v without AccessKey, got %v", ErrOptProtocolParsingErrors, err)
+	}
+	if ErrorCode(err) != coap.GiterlabErrnoOptProtocolParsingErrors {
+		t.Errorf("Unexpected errno %v", ErrorCode(err))
+	}
+	if ErrorCode(errors.New("other")) != coap.GiterlabErrnoProtocolParsingErrors {
+		t.Errorf("Expected other errors to map to a parsing error")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	ok := (&DeviceResponse{Code: coap.GiterlabErrnoFirmwareUpdate, Payload: []byte("v2")}).Message()
+	r, err := ParseResponse(&ok, PV2)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v", err)
+	}
+	if r.Code != coap.GiterlabErrnoFirmwareUpdate || string(r.Payload) != "v2" {
+		t.Errorf("Unexpected response %#v", r)
+	}
+	if _, err := ParseResponse(&ok, PV1); err != ErrNotSupportProtocolVersion {
+		t.Errorf("Expected PV1 to reject a PV2 errno, got %v", err)
+	}
+
+	bad := ErrorResponse(ErrIllegalKey).Message()
+	r, err = ParseResponse(&bad, PV1)
+	if !errors.Is(err, ErrIllegalKey) {
+		t.Errorf("Expected %v, got %v", ErrIllegalKey, err)
+	}
+	if r == nil || r.Code != coap.GiterlabErrnoIllegalKey {
+		t.Errorf("Expected the response with the error, got %#v", r)
+	}
+
+	notFound := coap.Message{Code: coap.NotFound}
+	_, err = ParseResponse(&notFound, PV2)
+	if err == nil || err.Error() != "giterlab: error response NotFound" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
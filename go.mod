@@ -1,3 +1,9 @@
 module github.com/GiterLab/go-coap
 
 go 1.16
+
+require (
+	github.com/pion/dtls/v2 v2.2.12
+	github.com/pion/transport/v2 v2.2.4
+	golang.org/x/net v0.20.0
+)
@@ -56,27 +56,29 @@ const (
 
 // Response Codes
 const (
-	Created               CCode = 65
-	Deleted               CCode = 66
-	Valid                 CCode = 67
-	Changed               CCode = 68
-	Content               CCode = 69
-	BadRequest            CCode = 128
-	Unauthorized          CCode = 129
-	BadOption             CCode = 130
-	Forbidden             CCode = 131
-	NotFound              CCode = 132
-	MethodNotAllowed      CCode = 133
-	NotAcceptable         CCode = 134
-	PreconditionFailed    CCode = 140
-	RequestEntityTooLarge CCode = 141
-	UnsupportedMediaType  CCode = 143
-	InternalServerError   CCode = 160
-	NotImplemented        CCode = 161
-	BadGateway            CCode = 162
-	ServiceUnavailable    CCode = 163
-	GatewayTimeout        CCode = 164
-	ProxyingNotSupported  CCode = 165
+	Created                 CCode = 65
+	Deleted                 CCode = 66
+	Valid                   CCode = 67
+	Changed                 CCode = 68
+	Content                 CCode = 69
+	Continue                CCode = 95
+	BadRequest              CCode = 128
+	Unauthorized            CCode = 129
+	BadOption               CCode = 130
+	Forbidden               CCode = 131
+	NotFound                CCode = 132
+	MethodNotAllowed        CCode = 133
+	NotAcceptable           CCode = 134
+	RequestEntityIncomplete CCode = 136
+	PreconditionFailed      CCode = 140
+	RequestEntityTooLarge   CCode = 141
+	UnsupportedMediaType    CCode = 143
+	InternalServerError     CCode = 160
+	NotImplemented          CCode = 161
+	BadGateway              CCode = 162
+	ServiceUnavailable      CCode = 163
+	GatewayTimeout          CCode = 164
+	ProxyingNotSupported    CCode = 165
 
 	// All Code values are assigned by sub-registries according to the
 	// following ranges:
@@ -121,31 +123,33 @@ const (
 )
 
 var codeNames = [256]string{
-	GET:                   "GET",
-	POST:                  "POST",
-	PUT:                   "PUT",
-	DELETE:                "DELETE",
-	Created:               "Created",
-	Deleted:               "Deleted",
-	Valid:                 "Valid",
-	Changed:               "Changed",
-	Content:               "Content",
-	BadRequest:            "BadRequest",
-	Unauthorized:          "Unauthorized",
-	BadOption:             "BadOption",
-	Forbidden:             "Forbidden",
-	NotFound:              "NotFound",
-	MethodNotAllowed:      "MethodNotAllowed",
-	NotAcceptable:         "NotAcceptable",
-	PreconditionFailed:    "PreconditionFailed",
-	RequestEntityTooLarge: "RequestEntityTooLarge",
-	UnsupportedMediaType:  "UnsupportedMediaType",
-	InternalServerError:   "InternalServerError",
-	NotImplemented:        "NotImplemented",
-	BadGateway:            "BadGateway",
-	ServiceUnavailable:    "ServiceUnavailable",
-	GatewayTimeout:        "GatewayTimeout",
-	ProxyingNotSupported:  "ProxyingNotSupported",
+	GET:                     "GET",
+	POST:                    "POST",
+	PUT:                     "PUT",
+	DELETE:                  "DELETE",
+	Created:                 "Created",
+	Deleted:                 "Deleted",
+	Valid:                   "Valid",
+	Changed:                 "Changed",
+	Content:                 "Content",
+	Continue:                "Continue",
+	BadRequest:              "BadRequest",
+	Unauthorized:            "Unauthorized",
+	BadOption:               "BadOption",
+	Forbidden:               "Forbidden",
+	NotFound:                "NotFound",
+	MethodNotAllowed:        "MethodNotAllowed",
+	NotAcceptable:           "NotAcceptable",
+	RequestEntityIncomplete: "RequestEntityIncomplete",
+	PreconditionFailed:      "PreconditionFailed",
+	RequestEntityTooLarge:   "RequestEntityTooLarge",
+	UnsupportedMediaType:    "UnsupportedMediaType",
+	InternalServerError:     "InternalServerError",
+	NotImplemented:          "NotImplemented",
+	BadGateway:              "BadGateway",
+	ServiceUnavailable:      "ServiceUnavailable",
+	GatewayTimeout:          "GatewayTimeout",
+	ProxyingNotSupported:    "ProxyingNotSupported",
 
 	GiterlabErrnoOk:             "giterlabErrnoOk:",
 	GiterlabErrnoParamConfigure: "giterlabErrnoParamConfigure",
@@ -183,8 +187,9 @@ func init() {
 	}
 }
 
+// String names c in the dialect set with SetCodeDialect.
 func (c CCode) String() string {
-	return codeNames[c]
+	return currentCodeDialect().CodeString(c)
 }
 
 // Message encoding errors.
@@ -219,6 +224,32 @@ type OptionID uint32
    |  39 | x  | x | - |   | Proxy-Scheme   | string | 1-255  | (none)  |
    |  60 |    |   | x |   | Size1          | uint   | 0-4    | (none)  |
    +-----+----+---+---+---+----------------+--------+--------+---------+
+
+   Block-wise transfer options (RFC7959 section 2.1)
+
+   +-----+---+---+---+---+--------+--------+--------+---------+
+   | No. | C | U | N | R | Name   | Format | Length | Default |
+   +-----+---+---+---+---+--------+--------+--------+---------+
+   |  23 | C | U | - | - | Block2 | uint   |    0-3 | (none)  |
+   |  27 | C | U | - | - | Block1 | uint   |    0-3 | (none)  |
+   |  28 |   |   | x |   | Size2  | uint   |    0-4 | (none)  |
+   +-----+---+---+---+---+--------+--------+--------+---------+
+
+   Request-Tag option (RFC9175 section 3.2)
+
+   +-----+---+---+---+---+-------------+--------+--------+---------+
+   | No. | C | U | N | R | Name        | Format | Length | Default |
+   +-----+---+---+---+---+-------------+--------+--------+---------+
+   | 292 |   |   |   | x | Request-Tag | opaque |    0-8 | (none)  |
+   +-----+---+---+---+---+-------------+--------+--------+---------+
+
+   No-Response option (RFC7967 section 2)
+
+   +-----+---+---+---+---+-------------+--------+--------+---------+
+   | No. | C | U | N | R | Name        | Format | Length | Default |
+   +-----+---+---+---+---+-------------+--------+--------+---------+
+   | 258 |   | U | - |   | No-Response | uint   |    0-1 | 0       |
+   +-----+---+---+---+---+-------------+--------+--------+---------+
 */
 
 // Option IDs.
@@ -236,9 +267,14 @@ const (
 	URIQuery      OptionID = 15
 	Accept        OptionID = 17
 	LocationQuery OptionID = 20
+	Block2        OptionID = 23
+	Block1        OptionID = 27
+	Size2         OptionID = 28
 	ProxyURI      OptionID = 35
 	ProxyScheme   OptionID = 39
 	Size1         OptionID = 60
+	NoResponse    OptionID = 258
+	RequestTag    OptionID = 292
 
 	// The IANA policy for future additions to this sub-registry is split
 	// into three tiers as follows.  The range of 0..255 is reserved for
@@ -293,9 +329,14 @@ var optionDefs = [65536]optionDef{
 	URIQuery:      {valueFormat: valueString, minLen: 0, maxLen: 255},
 	Accept:        {valueFormat: valueUint, minLen: 0, maxLen: 2},
 	LocationQuery: {valueFormat: valueString, minLen: 0, maxLen: 255},
+	Block2:        {valueFormat: valueUint, minLen: 0, maxLen: 3},
+	Block1:        {valueFormat: valueUint, minLen: 0, maxLen: 3},
+	Size2:         {valueFormat: valueUint, minLen: 0, maxLen: 4},
 	ProxyURI:      {valueFormat: valueString, minLen: 1, maxLen: 1034},
 	ProxyScheme:   {valueFormat: valueString, minLen: 1, maxLen: 255},
 	Size1:         {valueFormat: valueUint, minLen: 0, maxLen: 4},
+	NoResponse:    {valueFormat: valueUint, minLen: 0, maxLen: 1},
+	RequestTag:    {valueFormat: valueOpaque, minLen: 0, maxLen: 8},
 
 	// GiterLab: add private options
 	GiterLabID:    {valueFormat: valueString, minLen: 0, maxLen: 255},
@@ -380,8 +421,7 @@ func (o option) toBytes() []byte {
 	return encodeInt(v)
 }
 
-func parseOptionValue(optionID OptionID, valueBuf []byte) interface{} {
-	def := optionDefs[optionID]
+func parseOptionValue(optionID OptionID, def optionDef, valueBuf []byte) interface{} {
 	if def.valueFormat == valueUnknown {
 		// Skip unrecognized options (RFC7252 section 5.4.1)
 		return nil
@@ -449,6 +489,12 @@ func (m Message) IsConfirmable() bool {
 	return m.Type == Confirmable
 }
 
+// IsEmpty returns true if this is an empty message (code 0.00),
+// such as an empty ACK or a Reset.
+func (m Message) IsEmpty() bool {
+	return m.Code == 0
+}
+
 // Options gets all the values for the given option.
 func (m Message) Options(o OptionID) []interface{} {
 	var rv []interface{}
@@ -561,7 +607,14 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 		tmpbuf[0], tmpbuf[1],
 	})
 	buf.Write(m.Token)
+	m.marshalBody(&buf)
 
+	return buf.Bytes(), nil
+}
+
+// marshalBody writes the options and payload of this Message, the
+// part shared by the UDP and TCP encodings.
+func (m *Message) marshalBody(buf *bytes.Buffer) {
 	/*
 	     0   1   2   3   4   5   6   7
 	   +---------------+---------------+
@@ -625,11 +678,13 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 		writeExt(l, lx)
 	}
 
-	sort.Stable(&m.opts)
+	// sort a copy, so that encoding never modifies m
+	opts := append(options(nil), m.opts...)
+	sort.Stable(&opts)
 
 	prev := 0
 
-	for _, o := range m.opts {
+	for _, o := range opts {
 		b := o.toBytes()
 		writeOptHeader(int(o.ID)-prev, len(b))
 		buf.Write(b)
@@ -641,8 +696,6 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 	}
 
 	buf.Write(m.Payload)
-
-	return buf.Bytes(), nil
 }
 
 // ParseMessage extracts the Message from the given input.
@@ -677,7 +730,13 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 		return errors.New("truncated")
 	}
 	copy(m.Token, data[4:4+tokenLen])
-	b := data[4+tokenLen:]
+	return m.unmarshalBody(data[4+tokenLen:], false)
+}
+
+// unmarshalBody parses the options and payload of a Message.  The
+// options of signaling messages are parsed by the definitions for
+// their code.
+func (m *Message) unmarshalBody(b []byte, signal bool) error {
 	prev := 0
 
 	parseExtOpt := func(opt int) (int, error) {
@@ -727,7 +786,11 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 		}
 
 		oid := OptionID(prev + delta)
-		opval := parseOptionValue(oid, b[:length])
+		def := optionDefs[oid]
+		if signal {
+			def = signalOptionDefs[m.Code][oid]
+		}
+		opval := parseOptionValue(oid, def, b[:length])
 		b = b[length:]
 		prev = int(oid)
 
@@ -5,6 +5,7 @@ import (
 	"encoding"
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -32,6 +33,12 @@ func assertEqualMessages(t *testing.T, e, a Message) {
 		t.Errorf("Expected payload %#v, got %#v", e.Payload, a.Payload)
 	}
 
+	// compare the options in wire order
+	e.opts = append(options(nil), e.opts...)
+	a.opts = append(options(nil), a.opts...)
+	sort.Stable(&e.opts)
+	sort.Stable(&a.opts)
+
 	if len(e.opts) != len(a.opts) {
 		t.Errorf("Expected %v options, got %v", len(e.opts), len(a.opts))
 	} else {
@@ -791,6 +798,9 @@ func TestEncodeMessageWithAllOptions(t *testing.T) {
 	req.AddOption(URIQuery, "URIQUERY")
 	req.AddOption(Accept, TextPlain)
 	req.AddOption(LocationQuery, "LOCATIONQUERY")
+	req.AddOption(Block2, uint32(0x1236))
+	req.AddOption(Block1, uint32(0x2a))
+	req.AddOption(Size2, uint32(9999))
 	req.AddOption(ProxyURI, "PROXYURI")
 	req.AddOption(ProxyScheme, "PROXYSCHEME")
 	req.AddOption(Size1, uint32(9999))
@@ -1,13 +1,173 @@
 package coap
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
+// ErrMessageTooLarge is returned when a message read from a stream is
+// larger than the reader accepts.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// TCPFraming selects how messages are framed on a byte stream.
+type TCPFraming uint8
+
+const (
+	// FramingRFC8323 is the framing of RFC 8323 section 3.2: a
+	// variable length header without Type and MessageID.
+	FramingRFC8323 TCPFraming = iota
+	// FramingLegacy is the framing of early drafts used by older
+	// devices: a 16-bit length followed by the UDP encoding.  See
+	// TCPMessage.
+	FramingLegacy
+)
+
+func (f TCPFraming) String() string {
+	switch f {
+	case FramingRFC8323:
+		return "RFC8323"
+	case FramingLegacy:
+		return "Legacy"
+	}
+	return fmt.Sprintf("TCPFraming(%d)", uint8(f))
+}
+
+const (
+	tcpLenByteCode   = 13
+	tcpLenByteAddend = 13
+	tcpLenWordCode   = 14
+	tcpLenWordAddend = 269
+	tcpLenLongCode   = 15
+	tcpLenLongAddend = 65805
+)
+
+// Marshal produces the binary form of m framed for a stream.
+func (f TCPFraming) Marshal(m *Message) ([]byte, error) {
+	if f == FramingLegacy {
+		return (&TCPMessage{*m}).MarshalBinary()
+	}
+	if len(m.Token) > 8 {
+		return nil, ErrInvalidTokenLen
+	}
+
+	/*
+		A CoAP message over TCP (RFC 8323 section 3.2) looks like:
+
+		     0                   1                   2                   3
+		    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |  Len  |  TKL  | Extended Length (0, 8, 16 or 32 bits) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |      Code     | Token (if any, TKL bytes) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |   Options (if any) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |1 1 1 1 1 1 1 1|    Payload (if any) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+		Len is the length of the options and payload: 0-12 as is,
+		13, 14 or 15 when it is carried in 8, 16 or 32 bits of
+		Extended Length minus 13, 269 or 65805.
+	*/
+
+	body := bytes.Buffer{}
+	m.marshalBody(&body)
+	n := body.Len()
+
+	buf := bytes.Buffer{}
+	tkl := byte(len(m.Token))
+	switch {
+	case n < tcpLenByteAddend:
+		buf.WriteByte(byte(n)<<4 | tkl)
+	case n < tcpLenWordAddend:
+		buf.Write([]byte{tcpLenByteCode<<4 | tkl, byte(n - tcpLenByteAddend)})
+	case n < tcpLenLongAddend:
+		buf.WriteByte(tcpLenWordCode<<4 | tkl)
+		binary.Write(&buf, binary.BigEndian, uint16(n-tcpLenWordAddend))
+	default:
+		buf.WriteByte(tcpLenLongCode<<4 | tkl)
+		binary.Write(&buf, binary.BigEndian, uint32(n-tcpLenLongAddend))
+	}
+	buf.WriteByte(byte(m.Code))
+	buf.Write(m.Token)
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// Decode reads a single message framed for a stream.  Messages larger
+// than maxSize bytes are rejected with ErrMessageTooLarge; zero means
+// no limit.  Legacy frames are bounded by their 16-bit length alone.
+//
+// 7.xx messages are decoded as signaling with FramingRFC8323.
+func (f TCPFraming) Decode(r io.Reader, maxSize int) (*Message, error) {
+	return f.decode(r, maxSize, true)
+}
+
+// decode is Decode reading 7.xx messages as signaling only if signals
+// is set.
+func (f TCPFraming) decode(r io.Reader, maxSize int, signals bool) (*Message, error) {
+	if f == FramingLegacy {
+		m, err := Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		return &m.Message, nil
+	}
+
+	hdr := []byte{0}
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	tkl := int(hdr[0] & 0xf)
+	if tkl > 8 {
+		return nil, ErrInvalidTokenLen
+	}
+
+	var n int
+	switch l := int(hdr[0] >> 4); l {
+	case tcpLenByteCode:
+		var ext uint8
+		if err := binary.Read(r, binary.BigEndian, &ext); err != nil {
+			return nil, err
+		}
+		n = int(ext) + tcpLenByteAddend
+	case tcpLenWordCode:
+		var ext uint16
+		if err := binary.Read(r, binary.BigEndian, &ext); err != nil {
+			return nil, err
+		}
+		n = int(ext) + tcpLenWordAddend
+	case tcpLenLongCode:
+		var ext uint32
+		if err := binary.Read(r, binary.BigEndian, &ext); err != nil {
+			return nil, err
+		}
+		n = int(ext) + tcpLenLongAddend
+	default:
+		n = l
+	}
+	if maxSize > 0 && n+1+tkl > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	packet := make([]byte, 1+tkl+n)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+
+	m := Message{Code: CCode(packet[0])}
+	if tkl > 0 {
+		m.Token = packet[1 : 1+tkl]
+	}
+	return &m, m.unmarshalBody(packet[1+tkl:], signals && isSignal(m.Code))
+}
+
 // TCPMessage is a CoAP Message that can encode itself for TCP
-// transport.
+// transport with the legacy framing of early drafts (FramingLegacy).
+// Use FramingRFC8323 to talk to RFC 8323 peers.
 type TCPMessage struct {
 	Message
 }
@@ -50,7 +210,8 @@ func (m *TCPMessage) UnmarshalBinary(data []byte) error {
 	return m.Message.UnmarshalBinary(data)
 }
 
-// Decode reads a single message from its input.
+// Decode reads a single message from its input in the legacy framing
+// (FramingLegacy).
 func Decode(r io.Reader) (*TCPMessage, error) {
 	var ln uint16
 	err := binary.Read(r, binary.BigEndian, &ln)
@@ -34,3 +34,59 @@ func TestTCPDecodeMessageSmallWithPayload(t *testing.T) {
 		t.Errorf("Incorrect payload: %q", msg.Payload)
 	}
 }
+
+func TestTCPFramingRFC8323(t *testing.T) {
+	// GET with token 0x01 and Uri-Path "a", as in the RFC 8323 layout
+	msg := Message{Code: GET, Token: []byte{1}}
+	msg.SetPathString("a")
+	data, err := FramingRFC8323.Marshal(&msg)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	exp := []byte{0x21, 0x01, 0x01, 0xb1, 'a'}
+	if !bytes.Equal(data, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, data)
+	}
+
+	for _, size := range []int{0, 11, 12, 267, 268, 65803, 65804, 70000} {
+		req := Message{Code: POST, Token: []byte("tok")}
+		if size > 0 {
+			req.Payload = bytes.Repeat([]byte{'x'}, size)
+		}
+		data, err := FramingRFC8323.Marshal(&req)
+		if err != nil {
+			t.Fatalf("Error encoding %d bytes: %v", size, err)
+		}
+		m, err := FramingRFC8323.Decode(bytes.NewReader(data), 0)
+		if err != nil {
+			t.Fatalf("Error decoding %d bytes: %v", size, err)
+		}
+		if m.Code != POST || string(m.Token) != "tok" || !bytes.Equal(m.Payload, req.Payload) {
+			t.Errorf("Round trip of %d bytes failed: %v %q %d", size, m.Code, m.Token, len(m.Payload))
+		}
+	}
+
+	big := Message{Code: POST, Payload: make([]byte, 2048)}
+	data, _ = FramingRFC8323.Marshal(&big)
+	if _, err := FramingRFC8323.Decode(bytes.NewReader(data), 1152); err != ErrMessageTooLarge {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestTCPFramingLegacy(t *testing.T) {
+	req := Message{Type: Confirmable, Code: GET, MessageID: 12345, Payload: []byte("hi")}
+	data, err := FramingLegacy.Marshal(&req)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		t.Errorf("Expected a 16-bit length prefix, got %#v", data[:2])
+	}
+	m, err := FramingLegacy.Decode(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if m.MessageID != 12345 || string(m.Payload) != "hi" {
+		t.Errorf("Expected MessageID 12345 and payload hi, got %d %q", m.MessageID, m.Payload)
+	}
+}
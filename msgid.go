@@ -0,0 +1,107 @@
+package coap
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// messageIDs hands out message IDs per peer.  Each peer starts at a
+// random ID and counts up, skipping IDs used with that peer within
+// ExchangeLifetime.
+type messageIDs struct {
+	mu    sync.Mutex
+	peers map[string]*peerIDs
+	swept time.Time
+}
+
+type peerIDs struct {
+	next  uint16
+	used  map[uint16]time.Time
+	order []usedID
+}
+
+type usedID struct {
+	id uint16
+	at time.Time
+}
+
+// defaultMessageIDs is shared by all clients and servers in the
+// process, so IDs stay unique per peer no matter which side sends.
+var defaultMessageIDs = newMessageIDs()
+
+func newMessageIDs() *messageIDs {
+	return &messageIDs{
+		peers: make(map[string]*peerIDs),
+		swept: time.Now(),
+	}
+}
+
+// peer returns the ID space of a peer, dropping expired entries.
+func (s *messageIDs) peer(addr string, now time.Time) *peerIDs {
+	if now.Sub(s.swept) > ExchangeLifetime {
+		for k, p := range s.peers {
+			p.expire(now)
+			if len(p.order) == 0 {
+				delete(s.peers, k)
+			}
+		}
+		s.swept = now
+	}
+
+	p := s.peers[addr]
+	if p == nil {
+		p = &peerIDs{
+			next: uint16(rand.Intn(65535)) + 1,
+			used: make(map[uint16]time.Time),
+		}
+		s.peers[addr] = p
+	}
+	p.expire(now)
+	return p
+}
+
+func (p *peerIDs) expire(now time.Time) {
+	for len(p.order) > 0 && now.Sub(p.order[0].at) > ExchangeLifetime {
+		u := p.order[0]
+		if p.used[u.id].Equal(u.at) {
+			delete(p.used, u.id)
+		}
+		p.order = p.order[1:]
+	}
+}
+
+func (p *peerIDs) use(id uint16, now time.Time) {
+	p.used[id] = now
+	p.order = append(p.order, usedID{id, now})
+}
+
+// next allocates a message ID for addr.  Zero is never returned so
+// it can mean "unset" on outgoing messages.
+func (s *messageIDs) next(addr string) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	p := s.peer(addr, now)
+	id := p.next
+	for i := 0; i < 65536; i++ {
+		if _, ok := p.used[id]; !ok && id != 0 {
+			break
+		}
+		id++
+	}
+	p.next = id + 1
+	p.use(id, now)
+	return id
+}
+
+// use records an ID chosen by the caller so next will not hand it
+// out again within ExchangeLifetime.
+func (s *messageIDs) use(addr string, id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.peer(addr, now).use(id, now)
+}
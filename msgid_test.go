@@ -0,0 +1,75 @@
+package coap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageIDsIncrementPerPeer(t *testing.T) {
+	ids := newMessageIDs()
+
+	a := ids.next("a")
+	if b := ids.next("a"); b != a+1 && !(a == 65535 && b == 1) {
+		t.Errorf("Expected %d to follow %d", b, a)
+	}
+
+	ids.peers["b"] = &peerIDs{next: 65535, used: map[uint16]time.Time{}}
+	if id := ids.next("b"); id != 65535 {
+		t.Errorf("Expected 65535, got %d", id)
+	}
+	if id := ids.next("b"); id != 1 {
+		t.Errorf("Expected wraparound to skip 0, got %d", id)
+	}
+}
+
+func TestMessageIDsSkipUsed(t *testing.T) {
+	ids := newMessageIDs()
+	ids.peers["a"] = &peerIDs{next: 100, used: map[uint16]time.Time{}}
+
+	ids.use("a", 100)
+	ids.use("a", 101)
+	if id := ids.next("a"); id != 102 {
+		t.Errorf("Expected 102, got %d", id)
+	}
+}
+
+func TestMessageIDsExpire(t *testing.T) {
+	ids := newMessageIDs()
+	p := &peerIDs{next: 100, used: map[uint16]time.Time{}}
+	ids.peers["a"] = p
+
+	p.use(100, time.Now().Add(-ExchangeLifetime-time.Second))
+	p.use(101, time.Now())
+	if id := ids.next("a"); id != 100 {
+		t.Errorf("Expected expired ID 100 to be reused, got %d", id)
+	}
+	if id := ids.next("a"); id != 102 {
+		t.Errorf("Expected 102, got %d", id)
+	}
+}
+
+func TestTransmitAssignsMessageID(t *testing.T) {
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	seen := map[uint16]bool{}
+	buf := make([]byte, maxPktLen)
+	for i := 0; i < 10; i++ {
+		err := send(c.conn, &Message{Type: NonConfirmable, Code: GET})
+		if err != nil {
+			t.Fatalf("Error transmitting: %v", err)
+		}
+		nr, _, err := udpListener.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		m, _ := ParseMessage(buf[:nr])
+		if m.MessageID == 0 || seen[m.MessageID] {
+			t.Errorf("Expected a fresh MessageID, got %d", m.MessageID)
+		}
+		seen[m.MessageID] = true
+	}
+}
@@ -0,0 +1,47 @@
+package coap
+
+// No-Response option values (RFC 7967 section 2.1).  Each bit set
+// suppresses the responses of one class; zero asks for all of them.
+const (
+	NoResponse2xx = 0x02
+	NoResponse4xx = 0x08
+	NoResponse5xx = 0x10
+	// NoResponseAll suppresses every response.
+	NoResponseAll = NoResponse2xx | NoResponse4xx | NoResponse5xx
+)
+
+// suppressedClasses returns the response classes the request m does
+// not want, bit c-1 standing for class c.  FlagNoAck in the Flags
+// option suppresses all of them, including the GiterLab errnos.
+func suppressedClasses(m *Message) uint32 {
+	if flags, ok := m.Option(Flags).(uint32); ok && FlagIsNoAck(flags) {
+		return 0xff
+	}
+	v, _ := m.Option(NoResponse).(uint32)
+	return v & NoResponseAll
+}
+
+// wantsNoResponse reports whether the request m suppresses every
+// response, so that a client has nothing to wait for.
+func wantsNoResponse(m *Message) bool {
+	return suppressedClasses(m)&NoResponseAll == NoResponseAll
+}
+
+// noResponseWriter drops the responses of the classes in mask.  Empty
+// ACKs still go out.  d names the codes in the log.
+type noResponseWriter struct {
+	ResponseWriter
+	mask uint32
+	d    Dialect
+}
+
+func (w *noResponseWriter) WriteMsg(m *Message) error {
+	class := uint32(m.Code >> 5)
+	if class > 0 && w.mask&(1<<(class-1)) != 0 {
+		if debugEnable {
+			TraceInfo("[coap] suppressing %s response", w.d.CodeString(m.Code))
+		}
+		return nil
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,112 @@
+package coap
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNoResponseWriter(t *testing.T) {
+	tests := []struct {
+		opt       OptionID
+		val       uint32
+		code      CCode
+		delivered bool
+	}{
+		{NoResponse, 0, Content, true},
+		{NoResponse, NoResponse2xx, Content, false},
+		{NoResponse, NoResponse2xx, NotFound, true},
+		{NoResponse, NoResponse4xx, NotFound, false},
+		{NoResponse, NoResponse4xx | NoResponse5xx, InternalServerError, false},
+		{NoResponse, NoResponseAll, GiterlabErrnoDataError, true},
+		{Flags, FlagNoAck, GiterlabErrnoDataError, false},
+		{Flags, FlagNoAck, Content, false},
+		{Flags, 0, Content, true},
+	}
+	for _, test := range tests {
+		req := Message{Type: NonConfirmable, Code: POST}
+		req.SetOption(test.opt, test.val)
+		rec := &recordingWriter{}
+		var w ResponseWriter = rec
+		if mask := suppressedClasses(&req); mask != 0 {
+			w = &noResponseWriter{ResponseWriter: rec, mask: mask}
+		}
+		w.WriteMsg(&Message{Code: test.code})
+		if got := len(rec.msgs) == 1; got != test.delivered {
+			t.Errorf("%v=%#x, %v: expected delivered=%v", test.opt, test.val, test.code, test.delivered)
+		}
+
+		w.WriteMsg(&Message{Type: Acknowledgement})
+		if rec.msgs[len(rec.msgs)-1].Type != Acknowledgement {
+			t.Errorf("%v=%#x: expected the empty ACK to go out", test.opt, test.val)
+		}
+	}
+}
+
+func TestFlagNoAck(t *testing.T) {
+	var calls int32
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteMsg(&Message{Code: Changed, Payload: []byte("ok")})
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: POST, Payload: []byte("reading")}
+	req.SetPathString("/data")
+	req.SetOption(Flags, uint32(FlagNoAck))
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m != nil {
+		t.Errorf("Expected only an empty ACK, got %v", m.Code)
+	}
+
+	req.SetOption(Flags, uint32(0))
+	req.SetOption(NoResponse, uint32(NoResponse4xx))
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m == nil || m.Code != Changed {
+		t.Errorf("Expected %v, got %v", Changed, m)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected the handler to run twice, got %d", n)
+	}
+}
+
+func TestNoResponsePartial(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteMsg(&Message{Code: Changed, Payload: []byte("ok")})
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: POST, Payload: []byte("reading")}
+	req.SetPathString("/data")
+	req.SetOption(NoResponse, uint32(NoResponse2xx))
+	start := time.Now()
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m != nil {
+		t.Errorf("Expected the 2.04 response to be suppressed, got %v", m.Code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected Send to finish shortly after the empty ACK, took %v", d)
+	}
+}
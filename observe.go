@@ -0,0 +1,286 @@
+package coap
+
+import (
+	"strings"
+	"sync"
+)
+
+// Observe option values in requests (RFC 7641 section 2).
+const (
+	ObserveRegister   = 0
+	ObserveDeregister = 1
+)
+
+// maxObserveSeq bounds the 24-bit Observe sequence number.
+const maxObserveSeq = 1<<24 - 1
+
+// observeRegistry keeps the observers of each resource (RFC 7641).
+type observeRegistry struct {
+	mu        sync.Mutex
+	seq       uint32
+	resources map[string]map[observerKey]*observer
+}
+
+// observerKey identifies an observer by endpoint and token.
+type observerKey struct {
+	addr  string
+	token string
+}
+
+type observer struct {
+	key      observerKey
+	resource string
+	h        Handler
+	w        ResponseWriter
+	req      *Request
+
+	mu      sync.Mutex
+	lastMID uint16
+	sending bool
+	queued  *Message
+}
+
+func resourceName(path string) string {
+	return strings.Trim(path, "/")
+}
+
+func (reg *observeRegistry) nextSeq() uint32 {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.seq = (reg.seq + 1) & maxObserveSeq
+	return reg.seq
+}
+
+func (reg *observeRegistry) add(o *observer) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.resources == nil {
+		reg.resources = make(map[string]map[observerKey]*observer)
+	}
+	obs := reg.resources[o.resource]
+	if obs == nil {
+		obs = make(map[observerKey]*observer)
+		reg.resources[o.resource] = obs
+	}
+	obs[o.key] = o
+}
+
+func (reg *observeRegistry) remove(resource string, key observerKey) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.removeLocked(resource, key)
+}
+
+func (reg *observeRegistry) removeLocked(resource string, key observerKey) {
+	obs := reg.resources[resource]
+	if obs == nil {
+		return
+	}
+	delete(obs, key)
+	if len(obs) == 0 {
+		delete(reg.resources, resource)
+	}
+}
+
+// removeObserver removes o unless it has been replaced by a newer
+// registration.
+func (reg *observeRegistry) removeObserver(o *observer) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.resources[o.resource][o.key] == o {
+		reg.removeLocked(o.resource, o.key)
+	}
+}
+
+// reset removes the observer a Reset from addr refers to.
+func (reg *observeRegistry) reset(addr string, mid uint16) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for resource, obs := range reg.resources {
+		for key, o := range obs {
+			o.mu.Lock()
+			match := key.addr == addr && o.lastMID == mid
+			o.mu.Unlock()
+			if match {
+				reg.removeLocked(resource, key)
+				return
+			}
+		}
+	}
+}
+
+// removePeer removes all observers at addr, whose connection has
+// gone away.
+func (reg *observeRegistry) removePeer(addr string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for resource, obs := range reg.resources {
+		for key := range obs {
+			if key.addr == addr {
+				reg.removeLocked(resource, key)
+			}
+		}
+	}
+}
+
+func (reg *observeRegistry) list(resource string) []*observer {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	var rv []*observer
+	for _, o := range reg.resources[resource] {
+		rv = append(rv, o)
+	}
+	return rv
+}
+
+func isSuccess(c CCode) bool {
+	return c>>5 == 2
+}
+
+// serveCOAP dispatches a request to h, registering or removing an
+// observer when the request carries the Observe option, reassembling
+// Block1 uploads, splitting large responses into blocks and dropping
+// the responses the client does not want.
+func (srv *Server) serveCOAP(h Handler, w ResponseWriter, r *Request) {
+	w, r, ok := srv.assembleBlock1(w, r)
+	if !ok || srv.serveBlock2(w, r) {
+		return
+	}
+	if r.Msg.Code == GET {
+		if v, ok := r.Msg.Option(Observe).(uint32); ok {
+			key := observerKey{r.RemoteAddr.String(), string(r.Msg.Token)}
+			resource := resourceName(r.Msg.PathString())
+			switch v {
+			case ObserveRegister:
+				w = &observeWriter{
+					ResponseWriter: w,
+					srv:            srv,
+					o: &observer{
+						key:      key,
+						resource: resource,
+						h:        h,
+						w:        w,
+						req:      r,
+					},
+				}
+			case ObserveDeregister:
+				srv.observers.remove(resource, key)
+			}
+		}
+	}
+	w = &block2Writer{ResponseWriter: w, srv: srv, r: r}
+	if mask := suppressedClasses(r.Msg); mask != 0 {
+		w = &noResponseWriter{ResponseWriter: w, mask: mask, d: r.Dialect}
+	}
+	h.ServeCOAP(w, r)
+}
+
+// observeWriter completes an observe registration with the response
+// the handler writes.
+type observeWriter struct {
+	ResponseWriter
+	srv *Server
+	o   *observer
+
+	once sync.Once
+}
+
+func (w *observeWriter) WriteMsg(m *Message) error {
+	first := false
+	w.once.Do(func() { first = true })
+	if first {
+		if isSuccess(m.Code) {
+			m.SetOption(Observe, w.srv.observers.nextSeq())
+			w.srv.observers.add(w.o)
+		} else {
+			w.srv.observers.remove(w.o.resource, w.o.key)
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// notifyWriter turns the responses of a replayed registration request
+// into notifications for its observer.
+type notifyWriter struct {
+	srv *Server
+	o   *observer
+}
+
+func (w *notifyWriter) WriteMsg(m *Message) error {
+	o := w.o
+	m.Type = o.req.Msg.Type
+	m.MessageID = 0
+	m.Token = o.req.Msg.Token
+
+	success := isSuccess(m.Code)
+	if success {
+		m.SetOption(Observe, w.srv.observers.nextSeq())
+	} else {
+		// an error response ends the observation
+		m.RemoveOption(Observe)
+		w.srv.observers.removeObserver(o)
+	}
+
+	if cw, ok := o.w.(confirmableWriter); ok && m.IsConfirmable() {
+		// one confirmable notification in flight at a time; a newer
+		// one replaces any still waiting (RFC 7641 section 4.5.2)
+		o.mu.Lock()
+		if o.sending {
+			o.queued = m
+			o.mu.Unlock()
+			return nil
+		}
+		o.sending = true
+		o.mu.Unlock()
+
+		go w.sendConfirmable(cw, m)
+		return nil
+	}
+
+	err := o.w.WriteMsg(m)
+	o.mu.Lock()
+	o.lastMID = m.MessageID
+	o.mu.Unlock()
+	return err
+}
+
+func (w *notifyWriter) sendConfirmable(cw confirmableWriter, m *Message) {
+	o := w.o
+	for m != nil {
+		err := cw.writeConfirmable(m)
+
+		o.mu.Lock()
+		m, o.queued = o.queued, nil
+		if err != nil {
+			m = nil
+		}
+		o.sending = m != nil
+		o.mu.Unlock()
+
+		if err != nil {
+			if debugEnable {
+				TraceInfo("[coap] Remote: %v, dropping observer of %q: %s", o.req.RemoteAddr, o.resource, err)
+			}
+			w.srv.observers.removeObserver(o)
+		}
+	}
+}
+
+// Notify sends the current state of resource to its observers.  The
+// request each observer registered with is passed to the Handler
+// again and whatever it writes is sent as a notification with the
+// next Observe sequence number.  Notifications are confirmable if the
+// registration was; observers that reject a notification with Reset
+// or do not acknowledge it are removed.
+func (srv *Server) Notify(resource string) {
+	for _, o := range srv.observers.list(resourceName(resource)) {
+		// large notifications carry the first block, like the
+		// response to the registration (RFC 7959 section 3.4)
+		w := &block2Writer{ResponseWriter: &notifyWriter{srv: srv, o: o}, srv: srv, r: o.req}
+		o.h.ServeCOAP(w, o.req)
+	}
+}
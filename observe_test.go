@@ -0,0 +1,188 @@
+package coap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func startObserveServer(t *testing.T) (*Server, *Conn, func()) {
+	n := 0
+	mux := NewServeMux()
+	mux.Handle("/temp", HandlerFunc(func(w ResponseWriter, r *Request) {
+		n++
+		w.WriteMsg(&Message{Code: Content, Payload: []byte(fmt.Sprintf("%d", n))})
+	}))
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	srv := &Server{Handler: mux, ackTimeout: 5 * time.Millisecond}
+	go srv.Serve(udpListener)
+
+	c := dialTest(t, coapServerAddr)
+	c.ackTimeout = time.Second
+	return srv, c, func() {
+		c.Close()
+		srv.Close()
+	}
+}
+
+func observeRequest(typ CType, token string, observe int) Message {
+	req := Message{Type: typ, Code: GET, Token: []byte(token)}
+	req.SetPathString("/temp")
+	req.SetOption(Observe, observe)
+	return req
+}
+
+func receiveNotification(t *testing.T, c *Conn) *Message {
+	m, err := c.Receive()
+	if err != nil {
+		t.Fatalf("Error receiving notification: %v", err)
+	}
+	return m
+}
+
+// dialBare opens a socket to the server of c that, unlike a Conn,
+// leaves acknowledging notifications to the test.
+func dialBare(t *testing.T, c *Conn) *net.UDPConn {
+	s, err := net.DialUDP("udp", nil, c.conn.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	return s
+}
+
+func exchangeBare(t *testing.T, s *net.UDPConn, req Message) Message {
+	if err := send(s, &req); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	m, err := receive(s, make([]byte, maxPktLen), time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving response: %v", err)
+	}
+	return m
+}
+
+func TestObserveRegisterNotifyDeregister(t *testing.T) {
+	srv, c, done := startObserveServer(t)
+	defer done()
+	s := dialBare(t, c)
+	defer s.Close()
+
+	m := exchangeBare(t, s, observeRequest(Confirmable, "obs", ObserveRegister))
+	seq, ok := m.Option(Observe).(uint32)
+	if !ok {
+		t.Fatalf("Expected an Observe option in the response, got %v", m.Option(Observe))
+	}
+
+	for i := 0; i < 2; i++ {
+		srv.Notify("/temp")
+		n, err := receive(s, make([]byte, maxPktLen), time.Second)
+		if err != nil {
+			t.Fatalf("Error receiving notification: %v", err)
+		}
+		if n.Type != Confirmable || string(n.Token) != "obs" {
+			t.Errorf("Expected a CON notification with the registration token, got %v %q", n.Type, n.Token)
+		}
+		next, _ := n.Option(Observe).(uint32)
+		if next <= seq {
+			t.Errorf("Expected Observe to increase past %d, got %d", seq, next)
+		}
+		seq = next
+		send(s, &Message{Type: Acknowledgement, MessageID: n.MessageID})
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(srv.observers.list("temp")) != 1 {
+		t.Fatalf("Expected the acknowledged observer to stay registered")
+	}
+
+	m = exchangeBare(t, s, observeRequest(Confirmable, "obs", ObserveDeregister))
+	if m.Option(Observe) != nil {
+		t.Errorf("Expected no Observe option after deregistering, got %v", m.Option(Observe))
+	}
+	if len(srv.observers.list("temp")) != 0 {
+		t.Errorf("Expected the observer to be removed")
+	}
+}
+
+func TestObserveReset(t *testing.T) {
+	srv, c, done := startObserveServer(t)
+	defer done()
+
+	go c.Send(observeRequest(NonConfirmable, "non", ObserveRegister))
+	receiveNotification(t, c)
+
+	srv.Notify("temp")
+	n := receiveNotification(t, c)
+	if n.Type != NonConfirmable {
+		t.Errorf("Expected a NON notification, got %v", n.Type)
+	}
+
+	send(c.conn, &Message{Type: Reset, MessageID: n.MessageID})
+	time.Sleep(20 * time.Millisecond)
+	if len(srv.observers.list("temp")) != 0 {
+		t.Errorf("Expected Reset to remove the observer")
+	}
+}
+
+func TestObserveConfirmableTimeout(t *testing.T) {
+	srv, c, done := startObserveServer(t)
+	defer done()
+
+	// a bare socket, which never acknowledges notifications
+	s := dialBare(t, c)
+	defer s.Close()
+	exchangeBare(t, s, observeRequest(Confirmable, "lost", ObserveRegister))
+
+	srv.Notify("temp")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.observers.list("temp")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the unacknowledged observer to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestObserveBlockwiseNotification(t *testing.T) {
+	n := 0
+	mux := NewServeMux()
+	mux.Handle("/temp", HandlerFunc(func(w ResponseWriter, r *Request) {
+		n++
+		w.WriteMsg(&Message{Code: Content, Payload: bytes.Repeat([]byte{byte('0' + n)}, 200)})
+	}))
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	srv := &Server{Handler: mux, MaxBlockSize: 64}
+	go srv.Serve(udpListener)
+	defer srv.Close()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+
+	go c.Send(observeRequest(NonConfirmable, "big", ObserveRegister))
+	receiveNotification(t, c)
+
+	srv.Notify("temp")
+	note := receiveNotification(t, c)
+	b, ok := note.Block(Block2)
+	if !ok || b.Num != 0 || !b.More || len(note.Payload) != 64 {
+		t.Fatalf("Expected the first 64 byte block, got %+v with %d bytes", b, len(note.Payload))
+	}
+	if note.Option(Observe) == nil {
+		t.Errorf("Expected the first block to carry Observe")
+	}
+
+	req := Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/temp")
+	req.SetBlock(Block2, BlockOption{Num: 1, SZX: b.SZX})
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error fetching block 1: %v", err)
+	}
+	if !bytes.Equal(m.Payload, bytes.Repeat([]byte("2"), 64)) {
+		t.Errorf("Expected block 1 of the notification, got %q", m.Payload)
+	}
+}
@@ -0,0 +1,172 @@
+package coap
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// memPacketConn is one end of an in-memory packet pipe.  Packets are
+// dropped when the peer's queue is full.
+type memPacketConn struct {
+	addr memAddr
+	peer *memPacketConn
+	in   chan memPacket
+
+	mu       sync.Mutex
+	deadline time.Time
+	wake     chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMemPacketConn(addr string) *memPacketConn {
+	return &memPacketConn{
+		addr:   memAddr(addr),
+		in:     make(chan memPacket, 16),
+		wake:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func memPipe() (*memPacketConn, *memPacketConn) {
+	a, b := newMemPacketConn("a"), newMemPacketConn("b")
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *memPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timeout = time.After(d)
+		}
+
+		select {
+		case p := <-c.in:
+			return copy(b, p.data), p.from, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+		}
+	}
+}
+
+func (c *memPacketConn) WriteTo(b []byte, a net.Addr) (int, error) {
+	if a.String() != c.peer.addr.String() {
+		return 0, &net.AddrError{Err: "unknown address", Addr: a.String()}
+	}
+	p := memPacket{append([]byte(nil), b...), c.addr}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case c.peer.in <- p:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *memPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestServePacket(t *testing.T) {
+	srvConn, cliConn := memPipe()
+
+	mux := NewServeMux()
+	mux.HandlePacketFunc("/hello", func(l net.PacketConn, a net.Addr, m *Message) *Message {
+		if l != srvConn {
+			t.Errorf("Expected listener %v, got %v", srvConn, l)
+		}
+		if a.String() != "b" {
+			t.Errorf("Expected remote address b, got %v", a)
+		}
+		return &Message{Code: Content, Payload: []byte("hello mem")}
+	})
+	srv := &Server{Handler: mux}
+	done := make(chan error, 1)
+	go func() { done <- srv.ServePacket(srvConn) }()
+
+	c := NewPacketConn(cliConn, srvConn.LocalAddr())
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/hello")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Type != Acknowledgement || string(rv.Payload) != "hello mem" {
+		t.Errorf("Unexpected response %v %q", rv.Type, rv.Payload)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Expected %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestTransmitPacket(t *testing.T) {
+	a, b := memPipe()
+
+	err := TransmitPacket(a, b.LocalAddr(), Message{Type: NonConfirmable, Code: GET, MessageID: 7})
+	if err != nil {
+		t.Fatalf("Error transmitting: %v", err)
+	}
+	m, err := ReceivePacket(b, make([]byte, maxPktLen))
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if m.Code != GET || m.MessageID != 7 {
+		t.Errorf("Unexpected message %v %d", m.Code, m.MessageID)
+	}
+
+	if err := TransmitPacket(a, nil, Message{Type: NonConfirmable, Code: GET}); err == nil {
+		t.Errorf("Expected an error without destination address")
+	}
+}
@@ -0,0 +1,176 @@
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// TransportKind identifies the transport a request arrived on.
+type TransportKind uint8
+
+// Transports.
+const (
+	TransportUDP TransportKind = iota
+	TransportTCP
+	TransportTLS
+	TransportDTLS
+	TransportWebSocket
+)
+
+var transportNames = map[TransportKind]string{
+	TransportUDP:       "udp",
+	TransportTCP:       "tcp",
+	TransportTLS:       "tls",
+	TransportDTLS:      "dtls",
+	TransportWebSocket: "ws",
+}
+
+func (k TransportKind) String() string {
+	if name, ok := transportNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%x)", uint8(k))
+}
+
+// Request is a CoAP request received by a server.
+type Request struct {
+	// Msg is the parsed request message.
+	Msg *Message
+	// RemoteAddr is the address of the peer that sent the request.
+	RemoteAddr net.Addr
+	// Transport is the transport the request arrived on.
+	Transport TransportKind
+	// Dialect is how the endpoint reads 6.xx and 7.xx codes; it is
+	// never DialectAuto.
+	Dialect Dialect
+	// TLS holds the state of the TLS connection the request
+	// arrived on, including the client's certificates.  It is nil
+	// for other transports.
+	TLS *tls.ConnectionState
+	// Device is the identity the request authenticated with, set
+	// by AuthHandler.
+	Device *Device
+
+	ctx  context.Context
+	conn net.PacketConn
+	peer *streamPeer
+}
+
+// Context returns the request's context.  It is canceled when the
+// server is closed.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed
+// to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// ResponseWriter is used by a Handler to send messages to the peer a
+// request came from.
+type ResponseWriter interface {
+	// WriteMsg sends a message to the peer.  The first message
+	// written is the response to the request; handlers may keep
+	// the ResponseWriter and write more messages later, for
+	// instance separate responses or notifications.
+	//
+	// A response whose Type and MessageID are left unset becomes
+	// a piggybacked ACK for a confirmable request and a
+	// non-confirmable message otherwise.  Messages without a Token
+	// get the request's.
+	WriteMsg(m *Message) error
+}
+
+// fillResponse completes the header fields of m that a handler left
+// unset.  first tells whether m is the response to req or a later
+// message.
+func fillResponse(req, m *Message, first bool) {
+	if first && m.Type == Confirmable && m.MessageID == 0 {
+		switch req.Type {
+		case Confirmable:
+			m.Type = Acknowledgement
+		case NonConfirmable:
+			m.Type = NonConfirmable
+		}
+	}
+	if m.Type == Acknowledgement && m.MessageID == 0 && req.IsConfirmable() {
+		m.MessageID = req.MessageID
+	}
+	if len(m.Token) == 0 && !m.IsEmpty() {
+		m.Token = req.Token
+	}
+}
+
+// udpResponseWriter writes to the UDP peer of a request and records
+// the response in the endpoint's deduplication cache.
+type udpResponseWriter struct {
+	ep   *udpEndpoint
+	addr net.Addr
+	req  *Message
+	key  dedupKey
+
+	mu        sync.Mutex
+	responded bool
+}
+
+func (w *udpResponseWriter) WriteMsg(m *Message) error {
+	w.mu.Lock()
+	first := !w.responded
+	w.responded = true
+	w.mu.Unlock()
+
+	if err := checkCode(w.ep.dialect, m.Code); err != nil {
+		return err
+	}
+	fillResponse(w.req, m, first)
+	if err := sendTo(w.ep.l, w.addr, m); err != nil {
+		return err
+	}
+
+	if first {
+		if d, err := m.MarshalBinary(); err == nil {
+			w.ep.dc.respond(w.key, d)
+		}
+	}
+	return nil
+}
+
+// writeConfirmable sends m as a confirmable message and waits until
+// the peer acknowledges it.
+func (w *udpResponseWriter) writeConfirmable(m *Message) error {
+	if err := checkCode(w.ep.dialect, m.Code); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.responded = true
+	w.mu.Unlock()
+
+	m.Type = Confirmable
+	fillResponse(w.req, m, false)
+	return w.ep.sendConfirmable(w.addr, m)
+}
+
+func (w *udpResponseWriter) hasResponded() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.responded
+}
+
+// confirmableWriter is implemented by ResponseWriters of transports
+// that acknowledge confirmable messages.
+type confirmableWriter interface {
+	writeConfirmable(m *Message) error
+}
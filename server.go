@@ -2,33 +2,93 @@
 package coap
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
 const maxPktLen = 1500
 
-// Handler is a type that handles CoAP messages.
+// Handler is a type that handles CoAP requests.
 type Handler interface {
-	// Handle the message and optionally return a response message.
-	ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message
+	// ServeCOAP handles the request and writes any response to w.
+	ServeCOAP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeCOAP calls f(w, r).
+func (f HandlerFunc) ServeCOAP(w ResponseWriter, r *Request) {
+	f(w, r)
 }
 
 type funcHandler func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message
 
-func (f funcHandler) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
-	return f(l, a, m)
+func (f funcHandler) ServeCOAP(w ResponseWriter, r *Request) {
+	l, _ := r.conn.(*net.UDPConn)
+	a, _ := r.RemoteAddr.(*net.UDPAddr)
+	rv := f(l, a, r.Msg)
+	if rv != nil {
+		w.WriteMsg(rv)
+	}
 }
 
-// FuncHandler builds a handler from a function.
+// FuncHandler builds a handler from a function that returns its
+// response.  The listener is nil for requests that did not arrive
+// over UDP.
 func FuncHandler(f func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message) Handler {
 	return funcHandler(f)
 }
 
-func handlePacket(l *net.UDPConn, data []byte, u *net.UDPAddr,
-	rh Handler) {
+type packetFuncHandler func(l net.PacketConn, a net.Addr, m *Message) *Message
+
+func (f packetFuncHandler) ServeCOAP(w ResponseWriter, r *Request) {
+	rv := f(r.conn, r.RemoteAddr, r.Msg)
+	if rv != nil {
+		w.WriteMsg(rv)
+	}
+}
+
+// PacketFuncHandler is like FuncHandler for any packet connection.
+// The listener is nil for requests that did not arrive on one.
+func PacketFuncHandler(f func(l net.PacketConn, a net.Addr, m *Message) *Message) Handler {
+	return packetFuncHandler(f)
+}
+
+// udpEndpoint is the state a Server keeps for one UDP listener.
+type udpEndpoint struct {
+	srv     *Server
+	l       net.PacketConn
+	kind    TransportKind
+	dialect Dialect
+	h       Handler
+	dc      *dedupCache
+
+	mu      sync.Mutex
+	pending map[dedupKey]chan *Message
+}
+
+func newUDPEndpoint(srv *Server, l net.PacketConn, h Handler) *udpEndpoint {
+	return &udpEndpoint{
+		srv:     srv,
+		l:       l,
+		kind:    packetTransport(l),
+		dialect: srv.Dialect.resolve(false),
+		h:       h,
+		dc:      newDedupCache(),
+		pending: make(map[dedupKey]chan *Message),
+	}
+}
+
+func (ep *udpEndpoint) handlePacket(data []byte, u net.Addr) {
 
 	defer func() {
 		data = nil
@@ -66,7 +126,7 @@ func handlePacket(l *net.UDPConn, data []byte, u *net.UDPAddr,
 		if len(data) == 4 {
 			if data[0] == 'R' && data[1] == 'U' && data[2] == 'O' && data[3] == 'K' {
 				// Response IMOK
-				l.WriteToUDP([]byte("IMOK"), u)
+				ep.l.WriteTo([]byte("IMOK"), u)
 				return
 			}
 		}
@@ -78,71 +138,678 @@ func handlePacket(l *net.UDPConn, data []byte, u *net.UDPAddr,
 		return
 	}
 
-	rv := rh.ServeCOAP(l, u, &msg)
-	if rv != nil {
-		Transmit(l, u, *rv)
+	switch {
+	case msg.Type == Acknowledgement || msg.Type == Reset:
+		ep.handleReply(u, &msg)
+		return
+	case msg.IsEmpty():
+		// CoAP ping (RFC 7252 section 4.3)
+		if msg.IsConfirmable() {
+			sendTo(ep.l, u, &Message{Type: Reset, MessageID: msg.MessageID})
+		}
+		return
+	}
+
+	w := &udpResponseWriter{ep: ep, addr: u, req: &msg}
+	lifetime := ExchangeLifetime
+	if msg.Type == NonConfirmable {
+		lifetime = NonLifetime
+	}
+	w.key = dedupKey{u.String(), msg.MessageID}
+	if response, dup := ep.dc.lookup(w.key, lifetime); dup {
+		if debugEnable {
+			TraceInfo("[coap] Remote: %v, duplicate MessageID: %d", u, msg.MessageID)
+		}
+		if response != nil {
+			ep.l.WriteTo(response, u)
+		}
+		return
+	}
+
+	ep.srv.serveCOAP(ep.h, w, &Request{
+		Msg:        &msg,
+		RemoteAddr: u,
+		Transport:  ep.kind,
+		Dialect:    ep.dialect,
+		ctx:        ep.srv.ctx,
+		conn:       ep.l,
+	})
+
+	if msg.IsConfirmable() && !w.hasResponded() {
+		// no piggybacked response, acknowledge the request
+		w.WriteMsg(&Message{Type: Acknowledgement})
 	}
 }
 
-// Transmit a message.
-func Transmit(l *net.UDPConn, a *net.UDPAddr, m Message) error {
-	d, err := m.MarshalBinary()
+// handleReply hands an ACK or Reset to the confirmable message it
+// answers.  A Reset answering a non-confirmable notification cancels
+// the observation.
+func (ep *udpEndpoint) handleReply(u net.Addr, msg *Message) {
+	key := dedupKey{u.String(), msg.MessageID}
+	ep.mu.Lock()
+	ch := ep.pending[key]
+	ep.mu.Unlock()
+
+	if ch != nil {
+		select {
+		case ch <- msg:
+		default:
+		}
+		return
+	}
+	if msg.Type == Reset {
+		ep.srv.observers.reset(u.String(), msg.MessageID)
+	}
+}
+
+// sendConfirmable transmits m to addr and retransmits it until it is
+// acknowledged.  It returns ErrReset if the peer rejects m and
+// ErrTimeout if it never answers.
+func (ep *udpEndpoint) sendConfirmable(addr net.Addr, m *Message) error {
+	if m.MessageID == 0 {
+		m.MessageID = defaultMessageIDs.next(addr.String())
+	}
+	key := dedupKey{addr.String(), m.MessageID}
+	ch := make(chan *Message, 1)
+	ep.mu.Lock()
+	ep.pending[key] = ch
+	ep.mu.Unlock()
+	defer func() {
+		ep.mu.Lock()
+		delete(ep.pending, key)
+		ep.mu.Unlock()
+	}()
+
+	err := sendTo(ep.l, addr, m)
 	if err != nil {
 		return err
 	}
 
+	timeout := initialTimeout(ep.srv.responseTimeout())
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for retransmits := 0; ; retransmits++ {
+		select {
+		case rv := <-ch:
+			if rv.Type == Reset {
+				return ErrReset
+			}
+			return nil
+		case <-timer.C:
+			if retransmits >= MaxRetransmit {
+				return ErrTimeout
+			}
+			err = sendTo(ep.l, addr, m)
+			if err != nil {
+				return err
+			}
+			timeout *= 2
+			timer.Reset(timeout)
+		case <-ep.srv.ctx.Done():
+			return ErrServerClosed
+		}
+	}
+}
+
+// Transmit a message.
+//
+// Confirmable and non-confirmable messages with a zero MessageID get
+// the next free ID for the destination.
+func Transmit(l *net.UDPConn, a *net.UDPAddr, m Message) error {
+	if a == nil {
+		return TransmitPacket(l, nil, m)
+	}
+	return TransmitPacket(l, a, m)
+}
+
+// TransmitPacket is like Transmit for any packet connection.  Without
+// a destination address l must be connected, that is a net.Conn.
+func TransmitPacket(l net.PacketConn, a net.Addr, m Message) error {
 	if a == nil {
-		_, err = l.Write(d)
+		c, ok := l.(net.Conn)
+		if !ok {
+			return errors.New("no destination address")
+		}
+		return send(c, &m)
+	}
+	return sendTo(l, a, &m)
+}
+
+// assignMessageID fills in the MessageID of m for peer, or records
+// the one the caller chose.
+func assignMessageID(peer string, m *Message) {
+	if m.Type != Confirmable && m.Type != NonConfirmable {
+		return
+	}
+	if m.MessageID == 0 {
+		m.MessageID = defaultMessageIDs.next(peer)
 	} else {
-		_, err = l.WriteTo(d, a)
+		defaultMessageIDs.use(peer, m.MessageID)
+	}
+}
+
+// send sends m to the peer of the connection c, filling in its
+// MessageID in place.
+func send(c net.Conn, m *Message) error {
+	d, err := marshalFor(c, m)
+	if err != nil {
+		return err
 	}
+	_, err = c.Write(d)
+	return err
+}
+
+// marshalFor fills in the MessageID of m for the peer of c and
+// encodes it.
+func marshalFor(c net.Conn, m *Message) ([]byte, error) {
+	var peer string
+	if ra := c.RemoteAddr(); ra != nil {
+		peer = ra.String()
+	}
+	assignMessageID(peer, m)
+	return m.MarshalBinary()
+}
+
+// sendTo sends m to a, filling in its MessageID in place.
+func sendTo(l net.PacketConn, a net.Addr, m *Message) error {
+	assignMessageID(a.String(), m)
+
+	d, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = l.WriteTo(d, a)
 	return err
 }
 
 // Receive a message.
 func Receive(l *net.UDPConn, buf []byte) (Message, error) {
-	l.SetReadDeadline(time.Now().Add(ResponseTimeout))
+	return ReceivePacket(l, buf)
+}
+
+// ReceivePacket is like Receive for any packet connection.
+func ReceivePacket(l net.PacketConn, buf []byte) (Message, error) {
+	return receive(l, buf, ResponseTimeout)
+}
 
-	nr, _, err := l.ReadFromUDP(buf)
+func receive(l net.PacketConn, buf []byte, timeout time.Duration) (Message, error) {
+	l.SetReadDeadline(time.Now().Add(timeout))
+
+	nr, _, err := l.ReadFrom(buf)
 	if err != nil {
 		return Message{}, err
 	}
 	return ParseMessage(buf[:nr])
 }
 
-// ListenAndServe binds to the given address and serve requests forever.
-func ListenAndServe(n, addr string, rh Handler) error {
-	uaddr, err := net.ResolveUDPAddr(n, addr)
-	if err != nil {
-		return err
+// ErrServerClosed is returned by the Server's Serve and
+// ListenAndServe methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	// DefaultAddr is the address a Server listens on when Addr is
+	// empty.
+	DefaultAddr = ":5683"
+	// DefaultBusyMaxAge is the Max-Age of 5.03 responses sent by a
+	// saturated Server when BusyMaxAge is not set.
+	DefaultBusyMaxAge = 5 * time.Second
+)
+
+// packet is a datagram waiting for a worker.
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// A Server defines parameters for running a CoAP server.
+type Server struct {
+	// Addr is the UDP address to listen on, DefaultAddr if empty.
+	Addr string
+	// Handler is invoked for each request.  Without one every
+	// request is answered with 4.04 Not Found.
+	Handler Handler
+	// ReadTimeout is the maximum duration a TCP, TLS or WebSocket
+	// connection may stay idle before it is closed.  Packet
+	// listeners are connectionless and wait for requests
+	// indefinitely.  Zero means no timeout.
+	ReadTimeout time.Duration
+	// MaxWorkers bounds the number of requests handled concurrently
+	// on each listener, the connections of a stream listener and of
+	// a WebSocketHandler sharing one bound.  Zero means a new
+	// goroutine per request.
+	MaxWorkers int
+	// QueueSize is the number of requests that may wait for a free
+	// worker when MaxWorkers is set.  Once the queue is full,
+	// confirmable requests and requests on streams are answered
+	// with 5.03 Service Unavailable and non-confirmable ones are
+	// dropped.
+	QueueSize int
+	// BusyMaxAge is the Max-Age of 5.03 responses sent when the
+	// queue is full, telling clients when to retry.  Zero means
+	// DefaultBusyMaxAge.
+	BusyMaxAge time.Duration
+	// TLSConfig configures ServeTLS and ListenAndServeTLS.  It may
+	// be nil.
+	TLSConfig *tls.Config
+	// Framing is the framing of TCP connections.  Signaling
+	// messages are only exchanged with FramingRFC8323.
+	Framing TCPFraming
+	// Dialect decides whether 6.xx and 7.xx codes are GiterLab
+	// errnos or RFC 8323 signaling.  The zero value, DialectAuto,
+	// picks signaling on RFC 8323 streams and errnos elsewhere.
+	Dialect Dialect
+	// MaxMessageSize is the largest message the server accepts over
+	// reliable transports, announced to clients in its CSM.  Zero
+	// means DefaultMaxMessageSize.
+	MaxMessageSize int
+	// MaxBlockSize is the largest Block2 block the server sends.
+	// Larger responses are split into blocks (RFC 7959).  Zero
+	// means DefaultBlockSize.
+	MaxBlockSize int
+	// MaxBodySize is the largest request body the server reassembles
+	// from Block1 blocks.  Larger uploads are answered with 4.13
+	// Request Entity Too Large.  Zero means DefaultMaxBodySize.
+	MaxBodySize int
+	// CheckOrigin decides whether WebSocketHandler accepts a
+	// handshake.  Nil accepts handshakes whose Origin header names
+	// the requested host, and those without one, which do not come
+	// from browsers.
+	CheckOrigin func(r *http.Request) bool
+
+	observers observeRegistry
+	blocks    blockCache
+	uploads   block1Assembler
+	// ackTimeout overrides ResponseTimeout for confirmable messages
+	// the server sends.
+	ackTimeout time.Duration
+
+	mu         sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	listeners  map[net.PacketConn]struct{}
+	streams    map[net.Listener]struct{}
+	peers      map[*streamPeer]struct{}
+	inShutdown bool
+	handlers   sync.WaitGroup
+}
+
+// ListenAndServe listens on srv.Addr and serves requests until the
+// server is shut down.
+func (srv *Server) ListenAndServe() error {
+	return srv.listenAndServe("udp")
+}
+
+func (srv *Server) listenAndServe(n string) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = DefaultAddr
 	}
 
-	l, err := net.ListenUDP(n, uaddr)
+	if strings.HasPrefix(n, "tcp") {
+		l, err := net.Listen(n, addr)
+		if err != nil {
+			return err
+		}
+		return srv.ServeTCP(l)
+	}
+
+	l, err := net.ListenPacket(n, addr)
 	if err != nil {
 		return err
 	}
 
-	return Serve(l, rh)
+	return srv.ServePacket(l)
 }
 
-// Serve processes incoming UDP packets on the given listener, and processes
-// these requests forever (or until the listener is closed).
-func Serve(listener *net.UDPConn, rh Handler) error {
+// Serve processes incoming UDP packets on the given listener until
+// the server is shut down, in which case ErrServerClosed is returned.
+//
+// Retransmitted requests are answered from a cache of the responses
+// sent within ExchangeLifetime, without calling the Handler again.
+func (srv *Server) Serve(l *net.UDPConn) error {
+	return srv.ServePacket(l)
+}
+
+// ServePacket is like Serve for any packet connection, for instance a
+// Unix datagram socket, an in-memory pipe or a DTLS listener.
+// Requests are reported as TransportDTLS when the network of l's
+// address is "dtls".
+func (srv *Server) ServePacket(l net.PacketConn) error {
+	if !srv.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	rh := srv.Handler
+	if rh == nil {
+		rh = HandlerFunc(notFoundHandler)
+	}
+
+	ep := newUDPEndpoint(srv, l, rh)
+
+	var queue chan packet
+	if srv.MaxWorkers > 0 {
+		queue = make(chan packet, srv.QueueSize)
+		defer close(queue)
+		for i := 0; i < srv.MaxWorkers; i++ {
+			go func() {
+				for p := range queue {
+					ep.handlePacket(p.data, p.addr)
+					srv.handlers.Done()
+				}
+			}()
+		}
+	}
+
 	buf := make([]byte, maxPktLen)
 	for {
-		nr, addr, err := listener.ReadFromUDP(buf)
+		if srv.shuttingDown() {
+			return ErrServerClosed
+		}
+		nr, addr, err := l.ReadFrom(buf)
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if neterr, ok := err.(net.Error); ok && (neterr.Temporary() || neterr.Timeout()) {
 				time.Sleep(5 * time.Millisecond)
 				continue
 			}
 			if debugEnable {
-				TraceInfo("[coap] Serve ReadFromUDP error: %s", err)
+				TraceInfo("[coap] Serve ReadFrom error: %s", err)
 			}
-			continue
+			return err
 		}
 		tmp := make([]byte, nr)
 		copy(tmp, buf)
-		go handlePacket(listener, tmp, addr, rh)
+
+		if !srv.startHandler() {
+			return ErrServerClosed
+		}
+		if queue == nil {
+			go func() {
+				defer srv.handlers.Done()
+				ep.handlePacket(tmp, addr)
+			}()
+			continue
+		}
+		select {
+		case queue <- packet{tmp, addr}:
+		default:
+			srv.handlers.Done()
+			srv.rejectBusy(l, tmp, addr)
+		}
+	}
+}
+
+// packetTransport tells the transport of requests read from l.
+func packetTransport(l net.PacketConn) TransportKind {
+	if a := l.LocalAddr(); a != nil && a.Network() == "dtls" {
+		return TransportDTLS
+	}
+	return TransportUDP
+}
+
+// ServeDTLS is ServePacket for a listener that reads the plaintext of
+// DTLS sessions, such as the one of package dtls, whose address
+// reports the "dtls" network.  Requests are reported as TransportDTLS.
+func (srv *Server) ServeDTLS(l net.PacketConn) error {
+	return srv.ServePacket(l)
+}
+
+// rejectBusy answers a confirmable request with 5.03 Service
+// Unavailable when all workers are busy.  Anything else is dropped.
+func (srv *Server) rejectBusy(l net.PacketConn, data []byte, addr net.Addr) {
+	msg, err := ParseMessage(data)
+	if err != nil || !msg.IsConfirmable() || msg.IsEmpty() {
+		return
 	}
+	if debugEnable {
+		TraceInfo("[coap] Remote: %v, server busy, rejecting MessageID: %d", addr, msg.MessageID)
+	}
+
+	rv := srv.busyResponse(&msg)
+	rv.Type = Acknowledgement
+	rv.MessageID = msg.MessageID
+	sendTo(l, addr, rv)
+}
+
+// busyResponse returns the 5.03 Service Unavailable response to req.
+func (srv *Server) busyResponse(req *Message) *Message {
+	maxAge := srv.BusyMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultBusyMaxAge
+	}
+	rv := &Message{Code: ServiceUnavailable, Token: req.Token}
+	rv.SetOption(MaxAge, uint32(maxAge/time.Second))
+	return rv
+}
+
+// requestLimit bounds the requests of the connections of one stream
+// listener: MaxWorkers run at once and QueueSize more wait for their
+// turn.  A nil requestLimit admits everything.
+type requestLimit struct {
+	admitted chan struct{}
+	running  chan struct{}
+}
+
+func (srv *Server) newRequestLimit() *requestLimit {
+	if srv.MaxWorkers <= 0 {
+		return nil
+	}
+	return &requestLimit{
+		admitted: make(chan struct{}, srv.MaxWorkers+srv.QueueSize),
+		running:  make(chan struct{}, srv.MaxWorkers),
+	}
+}
+
+// admit reports whether another request may run or wait.
+func (l *requestLimit) admit() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.admitted <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// run calls f, an admitted request, once a worker is free.
+func (l *requestLimit) run(f func()) {
+	if l == nil {
+		f()
+		return
+	}
+	l.running <- struct{}{}
+	defer func() {
+		<-l.running
+		<-l.admitted
+	}()
+	f()
+}
+
+func (srv *Server) responseTimeout() time.Duration {
+	if srv.ackTimeout > 0 {
+		return srv.ackTimeout
+	}
+	return ResponseTimeout
+}
+
+func (srv *Server) trackListener(l net.PacketConn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.inShutdown {
+		return false
+	}
+	srv.initLocked()
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackStreamListener(l net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.inShutdown {
+		return false
+	}
+	srv.initLocked()
+	srv.streams[l] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackPeer(p *streamPeer, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !add {
+		delete(srv.peers, p)
+		return true
+	}
+	if srv.inShutdown {
+		return false
+	}
+	srv.initLocked()
+	srv.peers[p] = struct{}{}
+	return true
+}
+
+func (srv *Server) initLocked() {
+	if srv.ctx == nil {
+		srv.listeners = make(map[net.PacketConn]struct{})
+		srv.streams = make(map[net.Listener]struct{})
+		srv.peers = make(map[*streamPeer]struct{})
+		srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// startHandler accounts for a new in-flight handler unless the server
+// is shutting down.
+func (srv *Server) startHandler() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.inShutdown {
+		return false
+	}
+	srv.handlers.Add(1)
+	return true
+}
+
+// armRead sets the deadline of the next read from the connection r
+// according to ReadTimeout.  It reports false once the server is shutting down, so
+// that the deadline set by Shutdown is never pushed back.
+func (srv *Server) armRead(r interface{ SetReadDeadline(time.Time) error }) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.inShutdown {
+		return false
+	}
+	if srv.ReadTimeout > 0 {
+		r.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
+	}
+	return true
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.inShutdown
+}
+
+// Shutdown gracefully shuts down the server.  It stops reading from
+// all listeners and connections, waits for in-flight handlers to send
+// their responses and then closes the listeners and releases the
+// connections.  If ctx is done first, the listeners are closed right
+// away and ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	for l := range srv.listeners {
+		// unblock the read loop but keep the socket for responses
+		l.SetReadDeadline(time.Now())
+	}
+	for l := range srv.streams {
+		l.Close()
+		delete(srv.streams, l)
+	}
+	for p := range srv.peers {
+		p.s.SetReadDeadline(time.Now())
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return srv.closeListeners()
+	case <-ctx.Done():
+		srv.closeListeners()
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners without waiting for
+// in-flight handlers.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	srv.mu.Unlock()
+	return srv.closeListeners()
+}
+
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.cancel != nil {
+		srv.cancel()
+	}
+
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(srv.listeners, l)
+	}
+	for l := range srv.streams {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(srv.streams, l)
+	}
+	for p := range srv.peers {
+		p.release()
+		delete(srv.peers, p)
+	}
+	return err
+}
+
+// ListenAndServe binds to the given address and serve requests forever.
+// Networks "tcp", "tcp4" and "tcp6" serve CoAP over TCP.
+func ListenAndServe(n, addr string, rh Handler) error {
+	server := &Server{Addr: addr, Handler: rh}
+	return server.listenAndServe(n)
+}
+
+// Serve processes incoming UDP packets on the given listener, and processes
+// these requests forever (or until the listener is closed).
+func Serve(listener *net.UDPConn, rh Handler) error {
+	server := &Server{Handler: rh}
+	return server.Serve(listener)
+}
+
+// ServeTCP accepts TCP connections on the given listener and processes
+// the requests on them forever (or until the listener is closed).
+func ServeTCP(listener net.Listener, rh Handler) error {
+	server := &Server{Handler: rh}
+	return server.ServeTCP(listener)
 }
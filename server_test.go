@@ -1,8 +1,13 @@
 package coap
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func startUDPLisenter(t *testing.T) (*net.UDPConn, string) {
@@ -35,6 +40,7 @@ func TestServeWithAckResponse(t *testing.T) {
 		Type:      Confirmable,
 		Code:      POST,
 		MessageID: 9876,
+		Token:     []byte("TOKEN"),
 		Payload:   []byte("Content sent by client"),
 	}
 	req.SetOption(ContentFormat, TextPlain)
@@ -44,6 +50,7 @@ func TestServeWithAckResponse(t *testing.T) {
 		Type:      Acknowledgement,
 		Code:      Content,
 		MessageID: req.MessageID,
+		Token:     req.Token,
 		Payload:   []byte("Reply from CoAP server"),
 	}
 	res.SetOption(ContentFormat, TextPlain)
@@ -88,3 +95,341 @@ func TestServeWithoutAckResponse(t *testing.T) {
 		t.Fatalf("Received response packet, but expected none")
 	}
 }
+
+func TestServeDuplicateRequest(t *testing.T) {
+	var calls int32
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		n := atomic.AddInt32(&calls, 1)
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Changed,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(fmt.Sprintf("call %d", n)),
+		}
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	// a proxy which loses the first response, so that the client
+	// retransmits its request
+	proxy, proxyAddr := startUDPLisenter(t)
+	defer proxy.Close()
+	upstream, err := net.Dial("udp", coapServerAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer upstream.Close()
+	var requests int32
+	clientAddr := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, maxPktLen)
+		for {
+			nr, addr, err := proxy.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&requests, 1) == 1 {
+				clientAddr <- addr
+			}
+			upstream.Write(buf[:nr])
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxPktLen)
+		addr := <-clientAddr
+		for n := 1; ; n++ {
+			nr, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			if n == 1 {
+				continue
+			}
+			proxy.WriteTo(buf[:nr], addr)
+		}
+	}()
+
+	c := dialTest(t, proxyAddr)
+	defer c.Close()
+
+	m, err := c.Send(Message{
+		Type:      Confirmable,
+		Code:      POST,
+		MessageID: 4242,
+		Token:     []byte("dup"),
+	})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if string(m.Payload) != "call 1" {
+		t.Errorf("Expected the cached response, got %q", m.Payload)
+	}
+	if n := atomic.LoadInt32(&requests); n < 2 {
+		t.Errorf("Expected the request to be retransmitted, got %d transmissions", n)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", n)
+	}
+}
+
+func TestServerShutdownWaitsForHandlers(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		close(entered)
+		<-release
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte("late"),
+		}
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	server := &Server{Handler: handler}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(udpListener) }()
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+	responses := make(chan *Message, 1)
+	go func() {
+		m, err := c.Send(Message{Type: Confirmable, Code: GET})
+		if err != nil {
+			t.Errorf("Error sending request: %v", err)
+		}
+		responses <- m
+	}()
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from Serve, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the handler finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	if m := <-responses; m == nil || string(m.Payload) != "late" {
+		t.Errorf("Expected the in-flight response to be sent, got %v", m)
+	}
+}
+
+func TestServerShutdownContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		<-release
+		return nil
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	server := &Server{Handler: handler}
+	go server.Serve(udpListener)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	send(c.conn, &Message{Type: NonConfirmable, Code: GET})
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := server.Serve(udpListener); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after shutdown, got %v", err)
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteMsg(&Message{Code: Content})
+	})
+	server := &Server{Handler: handler, ReadTimeout: 20 * time.Millisecond}
+	defer server.Close()
+
+	// an idle packet listener keeps serving
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(udpListener) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-served:
+		t.Fatalf("Expected Serve to keep running, got %v", err)
+	default:
+	}
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+	if _, err := c.Send(Message{Type: Confirmable, Code: GET}); err != nil {
+		t.Errorf("Error sending request after idling: %v", err)
+	}
+
+	// an idle stream connection is closed
+	tc, err := net.Dial("tcp", startTCPServer(t, server))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer tc.Close()
+	tc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(tc); err != nil {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	server := &Server{Handler: handler, MaxWorkers: 1, BusyMaxAge: 30 * time.Second}
+	go server.Serve(udpListener)
+	defer close(release)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	// occupy the only worker; retry until it has started
+	for busy := false; !busy; {
+		send(c.conn, &Message{Type: NonConfirmable, Code: GET})
+		select {
+		case <-entered:
+			busy = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	c.ackTimeout = time.Second
+	m, err := c.Send(Message{Type: Confirmable, Code: GET})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != ServiceUnavailable {
+		t.Errorf("Expected %v, got %v", ServiceUnavailable, m.Code)
+	}
+	if maxAge := m.Option(MaxAge); maxAge != uint32(30) {
+		t.Errorf("Expected Max-Age 30, got %v", maxAge)
+	}
+}
+
+func TestServeRequest(t *testing.T) {
+	ctxKey := struct{}{}
+	mux := NewServeMux()
+	mux.Handle("/multi", HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Transport != TransportUDP {
+			t.Errorf("Expected transport %v, got %v", TransportUDP, r.Transport)
+		}
+		if _, ok := r.RemoteAddr.(*net.UDPAddr); !ok {
+			t.Errorf("Expected a UDP remote address, got %v", r.RemoteAddr)
+		}
+		if r.Context() == nil || r.WithContext(context.WithValue(r.Context(), ctxKey, 1)).Context().Value(ctxKey) != 1 {
+			t.Errorf("Expected a usable request context")
+		}
+		for i := 0; i < 2; i++ {
+			w.WriteMsg(&Message{
+				Type:      NonConfirmable,
+				Code:      Content,
+				MessageID: r.Msg.MessageID + uint16(i),
+				Token:     r.Msg.Token,
+				Payload:   []byte(fmt.Sprintf("message %d", i)),
+			})
+		}
+	}))
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, mux)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	req := Message{Type: NonConfirmable, Code: GET, MessageID: 500, Token: []byte("multi")}
+	req.SetPathString("/multi")
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		m, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Error receiving message %d: %v", i, err)
+		}
+		if exp := fmt.Sprintf("message %d", i); string(m.Payload) != exp {
+			t.Errorf("Expected %q, got %q", exp, m.Payload)
+		}
+	}
+}
+
+func TestServeFillsResponse(t *testing.T) {
+	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{Code: Content, Payload: []byte("filled")}
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+	c.ackTimeout = time.Second
+
+	m, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 600, Token: []byte("fill")})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Type != Acknowledgement || m.MessageID != 600 || string(m.Token) != "fill" {
+		t.Errorf("Expected a piggybacked ACK, got %v %d %q", m.Type, m.MessageID, m.Token)
+	}
+
+	go c.Send(Message{Type: NonConfirmable, Code: GET, MessageID: 601, Token: []byte("non")})
+	m, err = c.Receive()
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if m.Type != NonConfirmable || m.MessageID == 601 || string(m.Token) != "non" {
+		t.Errorf("Expected a NON response, got %v %d %q", m.Type, m.MessageID, m.Token)
+	}
+}
+
+func TestServeEmptyAckAndSeparateResponse(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			w.WriteMsg(&Message{Type: Confirmable, Code: Content, Payload: []byte("separate")})
+		}()
+	})
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go Serve(udpListener, handler)
+
+	c := dialTest(t, coapServerAddr)
+	defer c.Close()
+
+	m, err := c.Send(Message{Type: Confirmable, Code: GET})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Type != Confirmable || string(m.Payload) != "separate" {
+		t.Errorf("Expected the separate response, got %v %q", m.Type, m.Payload)
+	}
+}
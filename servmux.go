@@ -48,27 +48,23 @@ func (mux *ServeMux) match(path string) (h Handler, pattern string) {
 	return
 }
 
-func notFoundHandler(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
-	if m.IsConfirmable() {
-		return &Message{
-			Type: Acknowledgement,
-			Code: NotFound,
-		}
+func notFoundHandler(w ResponseWriter, r *Request) {
+	if r.Msg.IsConfirmable() {
+		w.WriteMsg(&Message{Code: NotFound})
 	}
-	return nil
 }
 
 var _ = Handler(&ServeMux{})
 
-// ServeCOAP handles a single COAP message.  The message arrives from
-// the given listener having originated from the given UDPAddr.
-func (mux *ServeMux) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
-	h, _ := mux.match(m.PathString())
+// ServeCOAP dispatches the request to the handler whose pattern most
+// closely matches the request path.
+func (mux *ServeMux) ServeCOAP(w ResponseWriter, r *Request) {
+	h, _ := mux.match(r.Msg.PathString())
 	if h == nil {
-		h, _ = funcHandler(notFoundHandler), ""
+		h, _ = HandlerFunc(notFoundHandler), ""
 	}
 	// TODO:  Rewrite path?
-	return h.ServeCOAP(l, a, m)
+	h.ServeCOAP(w, r)
 }
 
 // Handle configures a handler for the given path.
@@ -92,3 +88,10 @@ func (mux *ServeMux) HandleFunc(pattern string,
 	f func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message) {
 	mux.Handle(pattern, FuncHandler(f))
 }
+
+// HandlePacketFunc is like HandleFunc for handlers of requests from
+// any packet connection.
+func (mux *ServeMux) HandlePacketFunc(pattern string,
+	f func(l net.PacketConn, a net.Addr, m *Message) *Message) {
+	mux.Handle(pattern, PacketFuncHandler(f))
+}
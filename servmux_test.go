@@ -19,18 +19,19 @@ func TestPathMatching(t *testing.T) {
 		return nil
 	})
 
+	w := &recordingWriter{}
 	msg := &Message{}
 	msg.SetPathString("/a")
-	m.ServeCOAP(nil, nil, msg)
+	m.ServeCOAP(w, &Request{Msg: msg})
 	msg.SetPathString("/a")
-	m.ServeCOAP(nil, nil, msg)
+	m.ServeCOAP(w, &Request{Msg: msg})
 	msg.SetPathString("/b")
-	m.ServeCOAP(nil, nil, msg)
+	m.ServeCOAP(w, &Request{Msg: msg})
 	msg.SetPathString("/c")
-	m.ServeCOAP(nil, nil, msg)
+	m.ServeCOAP(w, &Request{Msg: msg})
 	msg.Type = NonConfirmable
 	msg.SetPathString("/c")
-	m.ServeCOAP(nil, nil, msg)
+	m.ServeCOAP(w, &Request{Msg: msg})
 
 	if msgs["a"] != 2 {
 		t.Errorf("Expected 2 messages for /a, got %v", msgs["a"])
@@ -38,6 +39,19 @@ func TestPathMatching(t *testing.T) {
 	if msgs["b"] != 1 {
 		t.Errorf("Expected 1 message for /b, got %v", msgs["b"])
 	}
+	if len(w.msgs) != 1 || w.msgs[0].Code != NotFound {
+		t.Errorf("Expected a single NotFound response for /c, got %v", w.msgs)
+	}
+}
+
+// recordingWriter is a ResponseWriter that keeps the messages written.
+type recordingWriter struct {
+	msgs []*Message
+}
+
+func (w *recordingWriter) WriteMsg(m *Message) error {
+	w.msgs = append(w.msgs, m)
+	return nil
 }
 
 func TestPathMatch(t *testing.T) {
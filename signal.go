@@ -0,0 +1,69 @@
+package coap
+
+// Signaling codes (RFC 8323 section 5).  Signaling messages are only
+// exchanged over reliable transports.  They share the 7.xx code space
+// with the GiterLab errno codes; see Dialect.
+const (
+	CSM     CCode = 225 // 7.01 Capabilities and Settings Message
+	Ping    CCode = 226 // 7.02
+	Pong    CCode = 227 // 7.03
+	Release CCode = 228 // 7.04
+	Abort   CCode = 229 // 7.05
+)
+
+/*
+   Signaling options (RFC8323 section 5).  Their numbers are only
+   meaningful together with the signaling code of the message.
+
+   +------+-----+---+---+---+---------------------+--------+--------+
+   | Code | No. | C | R | E | Name                | Format | Length |
+   +------+-----+---+---+---+---------------------+--------+--------+
+   | 7.01 |   2 |   |   | x | Max-Message-Size    | uint   | 0-4    |
+   | 7.01 |   4 |   |   |   | Block-Wise-Transfer | empty  | 0      |
+   | 7.02 |   2 |   |   |   | Custody             | empty  | 0      |
+   | 7.03 |   2 |   |   |   | Custody             | empty  | 0      |
+   | 7.04 |   2 |   | x |   | Alternative-Address | string | 1-255  |
+   | 7.04 |   4 |   |   |   | Hold-Off            | uint   | 0-3    |
+   | 7.05 |   2 |   |   |   | Bad-CSM-Option      | uint   | 0-2    |
+   +------+-----+---+---+---+---------------------+--------+--------+
+*/
+
+// Signaling option IDs.
+const (
+	MaxMessageSize     OptionID = 2
+	BlockWiseTransfer  OptionID = 4
+	Custody            OptionID = 2
+	AlternativeAddress OptionID = 2
+	HoldOff            OptionID = 4
+	BadCSMOption       OptionID = 2
+)
+
+// DefaultMaxMessageSize is the largest message a peer accepts over a
+// reliable transport until its CSM says otherwise (RFC 8323 section
+// 5.3.1).
+const DefaultMaxMessageSize = 1152
+
+var signalOptionDefs = map[CCode]map[OptionID]optionDef{
+	CSM: {
+		MaxMessageSize:    {valueFormat: valueUint, minLen: 0, maxLen: 4},
+		BlockWiseTransfer: {valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	},
+	Ping: {
+		Custody: {valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	},
+	Pong: {
+		Custody: {valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	},
+	Release: {
+		AlternativeAddress: {valueFormat: valueString, minLen: 1, maxLen: 255},
+		HoldOff:            {valueFormat: valueUint, minLen: 0, maxLen: 3},
+	},
+	Abort: {
+		BadCSMOption: {valueFormat: valueUint, minLen: 0, maxLen: 2},
+	},
+}
+
+// isSignal reports whether c is in the 7.xx signaling class.
+func isSignal(c CCode) bool {
+	return c>>5 == 7
+}
@@ -0,0 +1,655 @@
+package coap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream connection errors.
+var (
+	// ErrReleased is returned for requests in flight when the peer
+	// releases the connection (RFC 8323 section 5.5).
+	ErrReleased = errors.New("connection released by peer")
+	// ErrAborted is returned for requests in flight when the peer
+	// aborts the connection (RFC 8323 section 5.6).
+	ErrAborted = errors.New("connection aborted by peer")
+)
+
+// releaseTimeout bounds the time spent telling a peer that the
+// connection is going away.
+const releaseTimeout = time.Second
+
+// messageStream reads and writes whole messages on a reliable,
+// ordered transport.
+type messageStream interface {
+	net.Conn
+
+	// readMsg reads the next message, rejecting messages larger
+	// than maxSize bytes with ErrMessageTooLarge.
+	readMsg(maxSize int) (*Message, error)
+	// writeMsg writes m unless it is larger than maxSize bytes,
+	// the peer's limit, in which case it returns
+	// ErrMessageTooLarge.  Zero means no limit.
+	writeMsg(m *Message, maxSize int) error
+	// signals tells whether the transport carries signaling
+	// messages.
+	signals() bool
+	// dialect returns the resolved dialect of the stream.
+	dialect() Dialect
+}
+
+// tcpStream frames messages on a TCP or TLS connection.
+type tcpStream struct {
+	net.Conn
+	r       *bufio.Reader
+	framing TCPFraming
+	d       Dialect
+
+	mu sync.Mutex
+}
+
+func newTCPStream(c net.Conn, f TCPFraming, d Dialect) *tcpStream {
+	return &tcpStream{
+		Conn:    c,
+		r:       bufio.NewReader(c),
+		framing: f,
+		d:       d.resolve(f == FramingRFC8323),
+	}
+}
+
+func (s *tcpStream) readMsg(maxSize int) (*Message, error) {
+	return s.framing.decode(s.r, maxSize, s.signals())
+}
+
+func (s *tcpStream) writeMsg(m *Message, maxSize int) error {
+	d, err := s.framing.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && len(d) > maxSize {
+		return ErrMessageTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.Conn.Write(d)
+	return err
+}
+
+func (s *tcpStream) signals() bool {
+	return s.framing == FramingRFC8323 && s.d == DialectRFC
+}
+
+func (s *tcpStream) dialect() Dialect {
+	return s.d
+}
+
+// newCSM builds the Capabilities and Settings Message announcing
+// maxSize and, if blockWise is set, support for block-wise transfers.
+func newCSM(maxSize int, blockWise bool) *Message {
+	m := &Message{Code: CSM}
+	m.SetOption(MaxMessageSize, uint32(maxSize))
+	if blockWise {
+		m.SetOption(BlockWiseTransfer, []byte{})
+	}
+	return m
+}
+
+// peerSettings holds what a peer announced in its CSM.
+type peerSettings struct {
+	mu        sync.Mutex
+	maxSize   int
+	blockWise bool
+}
+
+func (ps *peerSettings) update(m *Message) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if v, ok := m.Option(MaxMessageSize).(uint32); ok {
+		ps.maxSize = int(v)
+	}
+	if m.Option(BlockWiseTransfer) != nil {
+		ps.blockWise = true
+	}
+}
+
+func (ps *peerSettings) get() (maxSize int, blockWise bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.maxSize == 0 {
+		return DefaultMaxMessageSize, ps.blockWise
+	}
+	return ps.maxSize, ps.blockWise
+}
+
+// streamPeer is the state a Server keeps for one connection of a
+// reliable transport.
+type streamPeer struct {
+	srv  *Server
+	s    messageStream
+	h    Handler
+	kind TransportKind
+	tls  *tls.ConnectionState
+
+	peer peerSettings
+
+	// released is closed once the server releases the connection.
+	released chan struct{}
+	// limit bounds the requests handled at once.
+	limit *requestLimit
+}
+
+func (srv *Server) maxMessageSize() int {
+	if srv.MaxMessageSize > 0 {
+		return srv.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// ListenAndServeTCP listens on the TCP address srv.Addr and serves
+// requests until the server is shut down.
+func (srv *Server) ListenAndServeTCP() error {
+	return srv.listenAndServe("tcp")
+}
+
+// ServeTCP accepts TCP connections on l and serves the requests on
+// them until the server is shut down, in which case ErrServerClosed is
+// returned.
+//
+// With FramingRFC8323 the server sends its CSM when a connection is
+// accepted, answers Ping with Pong and closes the connection when the
+// client sends Release or Abort, unless srv.Dialect is DialectGiterLab.
+func (srv *Server) ServeTCP(l net.Listener) error {
+	return srv.serveStreams(l, TransportTCP, func(c net.Conn) (messageStream, error) {
+		return newTCPStream(c, srv.Framing, srv.Dialect), nil
+	})
+}
+
+// serveStreams accepts connections on l and serves each on a stream
+// made by newStream.
+func (srv *Server) serveStreams(l net.Listener, kind TransportKind, newStream func(net.Conn) (messageStream, error)) error {
+	if !srv.trackStreamListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	rh := srv.Handler
+	if rh == nil {
+		rh = HandlerFunc(notFoundHandler)
+	}
+	limit := srv.newRequestLimit()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			if debugEnable {
+				TraceInfo("[coap] Serve Accept error: %s", err)
+			}
+			return err
+		}
+
+		go func() {
+			s, err := newStream(c)
+			if err != nil {
+				if debugEnable {
+					TraceInfo("[coap] Remote: %v, %s", c.RemoteAddr(), err)
+				}
+				c.Close()
+				return
+			}
+			srv.serveStream(s, kind, rh, limit)
+		}()
+	}
+}
+
+// serveStream serves the requests on s until it is closed.  During a
+// shutdown it returns only once the server has released s, so that
+// callers closing s on return do not cut off in-flight responses.
+func (srv *Server) serveStream(s messageStream, kind TransportKind, rh Handler, limit *requestLimit) {
+	p := &streamPeer{
+		srv:      srv,
+		s:        s,
+		h:        rh,
+		kind:     kind,
+		tls:      tlsState(s),
+		released: make(chan struct{}),
+		limit:    limit,
+	}
+	if !srv.trackPeer(p, true) {
+		s.Close()
+		return
+	}
+	if p.serve() {
+		<-p.released
+	}
+}
+
+// serve reads messages from the peer until the connection is closed.
+// It reports whether the connection was left for the server to
+// release.
+func (p *streamPeer) serve() (kept bool) {
+	defer func() {
+		p.srv.observers.removePeer(p.s.RemoteAddr().String())
+		if p.srv.shuttingDown() {
+			// keep the connection for the responses of in-flight
+			// handlers; the server releases it when they are done
+			kept = true
+			return
+		}
+		p.srv.trackPeer(p, false)
+		p.s.Close()
+	}()
+
+	if p.s.signals() {
+		err := p.s.writeMsg(newCSM(p.srv.maxMessageSize(), true), 0)
+		if err != nil {
+			return
+		}
+	}
+
+	for {
+		if !p.srv.armRead(p.s) {
+			return
+		}
+		m, err := p.s.readMsg(p.srv.maxMessageSize())
+		if err != nil {
+			if err == ErrMessageTooLarge && p.s.signals() {
+				p.abort(&Message{Code: Abort, Payload: []byte("message too large")})
+			}
+			if debugEnable && !p.srv.shuttingDown() {
+				TraceInfo("[coap] Remote: %v, closing connection: %s", p.s.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if p.s.signals() && isSignal(m.Code) {
+			if !p.handleSignal(m) {
+				return
+			}
+			continue
+		}
+		if m.IsEmpty() || m.Code>>5 != 0 {
+			// keepalives and responses need no answer
+			continue
+		}
+
+		if !p.srv.startHandler() {
+			return
+		}
+		if !p.limit.admit() {
+			p.srv.handlers.Done()
+			p.rejectBusy(m)
+			continue
+		}
+		go p.limit.run(func() { p.handleRequest(m) })
+	}
+}
+
+// handleSignal acts on a signaling message and reports whether the
+// connection stays open.
+func (p *streamPeer) handleSignal(m *Message) bool {
+	switch m.Code {
+	case CSM:
+		p.peer.update(m)
+	case Ping:
+		p.write(&Message{Code: Pong, Token: m.Token})
+	case Release, Abort:
+		if debugEnable {
+			TraceInfo("[coap] Remote: %v, connection closed with %s, %s", p.s.RemoteAddr(),
+				p.s.dialect().CodeString(m.Code), m.Payload)
+		}
+		return false
+	}
+	return true
+}
+
+func (p *streamPeer) handleRequest(m *Message) {
+	defer p.srv.handlers.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			if debugEnable {
+				TraceError("[coap] handle request panic: %s", err)
+			}
+		}
+	}()
+
+	w := &streamResponseWriter{p: p, req: m}
+	p.srv.serveCOAP(p.h, w, &Request{
+		Msg:        m,
+		RemoteAddr: p.s.RemoteAddr(),
+		Transport:  p.kind,
+		Dialect:    p.s.dialect(),
+		TLS:        p.tls,
+		ctx:        p.srv.ctx,
+		peer:       p,
+	})
+}
+
+// rejectBusy answers m with 5.03 Service Unavailable when all workers
+// are busy.
+func (p *streamPeer) rejectBusy(m *Message) {
+	if debugEnable {
+		TraceInfo("[coap] Remote: %v, server busy, rejecting %X", p.s.RemoteAddr(), m.Token)
+	}
+	rv := p.srv.busyResponse(m)
+	fillResponse(m, rv, true)
+	p.write(rv)
+}
+
+func (p *streamPeer) write(m *Message) error {
+	maxSize, _ := p.peer.get()
+	if !p.s.signals() {
+		maxSize = 0
+	}
+	return p.s.writeMsg(m, maxSize)
+}
+
+// abort sends m, an Abort, and closes the connection.
+func (p *streamPeer) abort(m *Message) {
+	p.s.SetWriteDeadline(time.Now().Add(releaseTimeout))
+	p.s.writeMsg(m, 0)
+	p.s.Close()
+}
+
+// release tells the peer that the server is going away and closes
+// the connection.
+func (p *streamPeer) release() {
+	if p.s.signals() {
+		p.s.SetWriteDeadline(time.Now().Add(releaseTimeout))
+		p.s.writeMsg(&Message{Code: Release}, 0)
+	}
+	p.s.Close()
+	close(p.released)
+}
+
+// blockWise tells whether the peer takes block-wise transfers.
+func (p *streamPeer) blockWise() bool {
+	if !p.s.signals() {
+		return false
+	}
+	_, ok := p.peer.get()
+	return ok
+}
+
+// streamResponseWriter writes to the connection a request came on.
+type streamResponseWriter struct {
+	p   *streamPeer
+	req *Message
+
+	mu        sync.Mutex
+	responded bool
+}
+
+func (w *streamResponseWriter) WriteMsg(m *Message) error {
+	w.mu.Lock()
+	first := !w.responded
+	w.responded = true
+	w.mu.Unlock()
+
+	if err := checkCode(w.p.s.dialect(), m.Code); err != nil {
+		return err
+	}
+	fillResponse(w.req, m, first)
+	return w.p.write(m)
+}
+
+// StreamConn is a CoAP client connection over a reliable transport.
+//
+// A StreamConn may be used by multiple goroutines simultaneously.
+// Responses are matched to requests by token; there are no
+// acknowledgements or retransmissions.
+type StreamConn struct {
+	s        messageStream
+	peer     peerSettings
+	crcTable *crc32.Table
+
+	mu     sync.Mutex
+	tokens map[string]chan *Message
+	csm    chan struct{}
+	gotCSM bool
+
+	done chan struct{}
+	err  error
+}
+
+// DialTCP connects a CoAP client over TCP with the framing of RFC
+// 8323.
+func DialTCP(n, addr string) (*StreamConn, error) {
+	c, err := net.Dial(n, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPConn(c, FramingRFC8323, DialectAuto)
+}
+
+// NewTCPConn runs a CoAP client over the established connection c,
+// sending its CSM first when f is FramingRFC8323 and d reads 7.xx
+// codes as signaling.
+func NewTCPConn(c net.Conn, f TCPFraming, d Dialect) (*StreamConn, error) {
+	return newStreamConn(newTCPStream(c, f, d))
+}
+
+func newStreamConn(s messageStream) (*StreamConn, error) {
+	c := &StreamConn{
+		s:      s,
+		tokens: make(map[string]chan *Message),
+		csm:    make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if s.signals() {
+		// responses are not fetched block by block, so they may be
+		// as large as any body a server accepts
+		err := s.writeMsg(newCSM(DefaultMaxBodySize, false), 0)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	} else {
+		close(c.csm)
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *StreamConn) readLoop() {
+	var err error
+	for {
+		var m *Message
+		m, err = c.s.readMsg(DefaultMaxBodySize)
+		if err != nil {
+			break
+		}
+
+		if c.s.signals() && isSignal(m.Code) {
+			switch m.Code {
+			case CSM:
+				c.peer.update(m)
+				c.mu.Lock()
+				if !c.gotCSM {
+					c.gotCSM = true
+					close(c.csm)
+				}
+				c.mu.Unlock()
+				continue
+			case Ping:
+				c.write(&Message{Code: Pong, Token: m.Token})
+				continue
+			case Release:
+				err = ErrReleased
+			case Abort:
+				err = ErrAborted
+			case Pong:
+				c.route(m)
+				continue
+			default:
+				continue
+			}
+			break
+		}
+		if !m.IsEmpty() {
+			c.route(m)
+		}
+	}
+
+	c.s.Close()
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	close(c.done)
+}
+
+func (c *StreamConn) route(m *Message) {
+	c.mu.Lock()
+	ch := c.tokens[string(m.Token)]
+	c.mu.Unlock()
+
+	if ch == nil {
+		if debugEnable {
+			TraceInfo("[coap] discarding message with unknown token %X", m.Token)
+		}
+		return
+	}
+	select {
+	case ch <- m:
+	default:
+	}
+}
+
+func (c *StreamConn) write(m *Message) error {
+	maxSize, _ := c.peer.get()
+	if !c.s.signals() {
+		maxSize = 0
+	}
+	return c.s.writeMsg(m, maxSize)
+}
+
+func (c *StreamConn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Do sends a request and waits for its response.
+//
+// A random token is generated when req has none.  Requests larger
+// than the server's Max-Message-Size fail with ErrMessageTooLarge.
+// Do gives up when ctx is done and returns ctx.Err().
+func (c *StreamConn) Do(ctx context.Context, req *Message) (*Message, error) {
+	m := *req
+	if len(m.Token) == 0 {
+		m.Token = newToken()
+	}
+	if !c.s.signals() && m.MessageID == 0 {
+		// the legacy framing still carries MessageIDs
+		m.MessageID = defaultMessageIDs.next(c.s.RemoteAddr().String())
+	}
+	if c.crcTable != nil && len(m.Payload) > 0 && m.Option(CheckCRC32) == nil {
+		m.SetCRC32(c.crcTable)
+	}
+	return c.exchange(ctx, &m)
+}
+
+// SetCRC32 is like Conn.SetCRC32.
+func (c *StreamConn) SetCRC32(tab *crc32.Table) {
+	c.crcTable = tab
+}
+
+func (c *StreamConn) exchange(ctx context.Context, m *Message) (*Message, error) {
+	ch := make(chan *Message, 1)
+	key := string(m.Token)
+	c.mu.Lock()
+	if _, ok := c.tokens[key]; ok {
+		c.mu.Unlock()
+		return nil, ErrTokenInUse
+	}
+	c.tokens[key] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.tokens, key)
+		c.mu.Unlock()
+	}()
+
+	// the server's CSM tells how large requests may be
+	select {
+	case <-c.csm:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.closedErr()
+	}
+
+	if err := c.write(m); err != nil {
+		select {
+		case <-c.done:
+			return nil, c.closedErr()
+		default:
+			return nil, err
+		}
+	}
+	if wantsNoResponse(m) {
+		return nil, nil
+	}
+
+	select {
+	case rv := <-ch:
+		return rv, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.closedErr()
+	}
+}
+
+// Send a request and wait for its response.
+func (c *StreamConn) Send(req Message) (*Message, error) {
+	return c.Do(context.Background(), &req)
+}
+
+// Ping checks that the server is alive with a Ping signaling message
+// and waits for its Pong.
+func (c *StreamConn) Ping(ctx context.Context) error {
+	if !c.s.signals() {
+		return errors.New("no signaling on this connection")
+	}
+	_, err := c.exchange(ctx, &Message{Code: Ping, Token: newToken()})
+	return err
+}
+
+// MaxMessageSize returns the largest message the server accepts, as
+// announced in its CSM.
+func (c *StreamConn) MaxMessageSize() int {
+	maxSize, _ := c.peer.get()
+	return maxSize
+}
+
+// Close releases the connection.  Requests in flight fail with
+// net.ErrClosed.
+func (c *StreamConn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.mu.Unlock()
+
+	if c.s.signals() {
+		c.s.SetWriteDeadline(time.Now().Add(releaseTimeout))
+		c.s.writeMsg(&Message{Code: Release}, 0)
+	}
+	return c.s.Close()
+}
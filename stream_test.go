@@ -0,0 +1,171 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTCPServer(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen on TCP: %v", err)
+	}
+	go srv.ServeTCP(l)
+	return l.Addr().String()
+}
+
+func TestServeTCP(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/hello", HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Transport != TransportTCP {
+			t.Errorf("Expected transport %v, got %v", TransportTCP, r.Transport)
+		}
+		if _, ok := r.RemoteAddr.(*net.TCPAddr); !ok {
+			t.Errorf("Expected a TCP remote address, got %v", r.RemoteAddr)
+		}
+		w.WriteMsg(&Message{Code: Content, Payload: append([]byte("hello "), r.Msg.Payload...)})
+	}))
+	srv := &Server{Handler: mux, MaxMessageSize: 4096}
+	defer srv.Close()
+	addr := startTCPServer(t, srv)
+
+	c, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Code: POST, Payload: []byte("tcp")}
+	req.SetPathString("/hello")
+	m, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != Content || string(m.Payload) != "hello tcp" {
+		t.Errorf("Expected Content %q, got %v %q", "hello tcp", m.Code, m.Payload)
+	}
+	if size := c.MaxMessageSize(); size != 4096 {
+		t.Errorf("Expected the server's Max-Message-Size 4096, got %d", size)
+	}
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Error pinging: %v", err)
+	}
+
+	req.Payload = bytes.Repeat([]byte{'x'}, 5000)
+	if _, err := c.Send(req); err != ErrMessageTooLarge {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+
+	req.SetPathString("/missing")
+	req.Payload = nil
+	m, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != NotFound {
+		t.Errorf("Expected %v, got %v", NotFound, m.Code)
+	}
+}
+
+func TestServeTCPBusy(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			entered <- struct{}{}
+			<-release
+			w.WriteMsg(&Message{Code: Content})
+		}),
+		MaxWorkers: 1,
+		BusyMaxAge: 30 * time.Second,
+	}
+	defer srv.Close()
+	addr := startTCPServer(t, srv)
+
+	c, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	// occupy the only worker
+	first := make(chan *Message, 1)
+	go func() {
+		m, _ := c.Send(Message{Code: GET})
+		first <- m
+	}()
+	<-entered
+
+	m, err := c.Send(Message{Code: GET})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Code != ServiceUnavailable {
+		t.Errorf("Expected %v, got %v", ServiceUnavailable, m.Code)
+	}
+	if maxAge := m.Option(MaxAge); maxAge != uint32(30) {
+		t.Errorf("Expected Max-Age 30, got %v", maxAge)
+	}
+
+	close(release)
+	if m := <-first; m == nil || m.Code != Content {
+		t.Errorf("Expected the first request to be served, got %v", m)
+	}
+}
+
+func TestServeTCPShutdownReleases(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteMsg(&Message{Code: Content})
+	})}
+	addr := startTCPServer(t, srv)
+
+	c, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(Message{Code: GET}); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Error shutting down: %v", err)
+	}
+	<-c.done
+	if _, err := c.Send(Message{Code: GET}); err != ErrReleased {
+		t.Errorf("Expected ErrReleased, got %v", err)
+	}
+}
+
+func TestServeTCPLegacy(t *testing.T) {
+	srv := &Server{
+		Framing: FramingLegacy,
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.WriteMsg(&Message{Code: Content, Payload: []byte("legacy")})
+		}),
+	}
+	defer srv.Close()
+	addr := startTCPServer(t, srv)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	c, err := NewTCPConn(nc, FramingLegacy, DialectAuto)
+	if err != nil {
+		t.Fatalf("Error starting client: %v", err)
+	}
+	defer c.Close()
+
+	m, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 777})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if m.Type != Acknowledgement || m.MessageID != 777 || string(m.Payload) != "legacy" {
+		t.Errorf("Expected a piggybacked ACK, got %v %d %q", m.Type, m.MessageID, m.Payload)
+	}
+}
@@ -0,0 +1,146 @@
+package coap
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultTLSAddr is the address a Server listens on for CoAP
+	// over TLS when Addr is empty.
+	DefaultTLSAddr = ":5684"
+
+	// alpnProtocol identifies CoAP in the TLS handshake (RFC 8323
+	// section 4.1).
+	alpnProtocol = "coap"
+
+	// handshakeTimeout bounds the TLS handshake of a new connection.
+	handshakeTimeout = 10 * time.Second
+)
+
+// ErrNoALPN is returned when the peer of a TLS connection did not
+// negotiate the "coap" application protocol.
+var ErrNoALPN = errors.New("peer did not negotiate the coap protocol")
+
+// withALPN returns a copy of config offering the "coap" protocol.
+func withALPN(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	for _, p := range config.NextProtos {
+		if p == alpnProtocol {
+			return config
+		}
+	}
+	config.NextProtos = append(config.NextProtos, alpnProtocol)
+	return config
+}
+
+// handshake completes the TLS handshake of c and checks the
+// negotiated protocol.
+func handshake(c *tls.Conn) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := c.Handshake()
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if c.ConnectionState().NegotiatedProtocol != alpnProtocol {
+		return ErrNoALPN
+	}
+	return nil
+}
+
+// ListenAndServeTLS listens on the TCP address srv.Addr, DefaultTLSAddr
+// if empty, and serves CoAP over TLS until the server is shut down.
+// See ServeTLS for certFile and keyFile.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = DefaultTLSAddr
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS accepts TLS connections on l and serves the requests on
+// them like ServeTCP, always with the framing of RFC 8323.  Clients
+// must negotiate the "coap" protocol with ALPN.
+//
+// The certificate is loaded from certFile and keyFile unless
+// srv.TLSConfig already has one, in which case both may be empty.
+// Handlers find the client's certificates, if it sent any, in
+// Request.TLS.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := withALPN(srv.TLSConfig)
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return srv.serveStreams(l, TransportTLS, func(c net.Conn) (messageStream, error) {
+		tc := tls.Server(c, config)
+		if err := handshake(tc); err != nil {
+			return nil, err
+		}
+		return newTCPStream(tc, FramingRFC8323, srv.Dialect), nil
+	})
+}
+
+// DialTLS connects a CoAP client over TLS, offering the "coap"
+// protocol with ALPN.  config may be nil.
+func DialTLS(n, addr string, config *tls.Config) (*StreamConn, error) {
+	config = withALPN(config)
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	c, err := net.Dial(n, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, config)
+	if err := handshake(tc); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return NewTCPConn(tc, FramingRFC8323, DialectAuto)
+}
+
+// ListenAndServeTLS binds to the given TCP address and serves CoAP
+// over TLS forever.
+func ListenAndServeTLS(addr, certFile, keyFile string, rh Handler) error {
+	server := &Server{Addr: addr, Handler: rh}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// tlsState returns the TLS connection state of s, or nil for plain
+// connections.
+func tlsState(s messageStream) *tls.ConnectionState {
+	switch s := s.(type) {
+	case *tcpStream:
+		if tc, ok := s.Conn.(*tls.Conn); ok {
+			cs := tc.ConnectionState()
+			return &cs
+		}
+	case *wsStream:
+		return s.tls
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package coap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns the PEM encoded certificate and key for name.
+func (ca *testCA) issue(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) keyPair(t *testing.T, name string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, name)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Error loading key pair: %v", err)
+	}
+	return cert
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "server")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+
+	peers := make(chan string, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			if r.Transport != TransportTLS {
+				t.Errorf("Expected transport %v, got %v", TransportTLS, r.Transport)
+			}
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				t.Errorf("Expected the client certificate on the request")
+			} else {
+				peers <- r.TLS.PeerCertificates[0].Subject.CommonName
+			}
+			w.WriteMsg(&Message{Code: Content, Payload: []byte("secure")})
+		}),
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  ca.pool(),
+		},
+	}
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen on TCP: %v", err)
+	}
+	go srv.ServeTLS(l, certFile, keyFile)
+
+	c, err := DialTLS("tcp", l.Addr().String(), &tls.Config{
+		RootCAs:      ca.pool(),
+		Certificates: []tls.Certificate{ca.keyPair(t, "device-1")},
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	m, err := c.Send(Message{Code: GET})
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if string(m.Payload) != "secure" {
+		t.Errorf("Expected payload secure, got %q", m.Payload)
+	}
+	if peer := <-peers; peer != "device-1" {
+		t.Errorf("Expected peer device-1, got %q", peer)
+	}
+
+	// without ALPN the server hangs up after the handshake
+	tc, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: ca.pool()})
+	if err != nil {
+		t.Fatalf("Error dialing without ALPN: %v", err)
+	}
+	defer tc.Close()
+	tc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := tc.Read(make([]byte, 16))
+	if neterr, ok := err.(net.Error); err == nil || ok && neterr.Timeout() {
+		t.Errorf("Expected the connection to be closed, read %d bytes: %v", n, err)
+	}
+}
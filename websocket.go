@@ -0,0 +1,230 @@
+package coap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsProtocol is the WebSocket subprotocol of CoAP (RFC 8323 section
+// 4.3).
+const wsProtocol = "coap"
+
+// ErrNoSubprotocol is returned when a WebSocket peer does not speak the
+// "coap" subprotocol.
+var ErrNoSubprotocol = errors.New("peer did not negotiate the coap subprotocol")
+
+// marshalWS produces the binary form of m for a WebSocket message
+// (RFC 8323 section 4.4): the TCP encoding with Len always zero, as
+// the message length is known from the WebSocket frame.
+func marshalWS(m *Message) ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, ErrInvalidTokenLen
+	}
+
+	/*
+		A CoAP message over WebSockets looks like:
+
+		     0                   1                   2                   3
+		    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   | Len=0 |  TKL  |      Code     |    Token (TKL bytes) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |   Options (if any) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |1 1 1 1 1 1 1 1|    Payload (if any) ...
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	*/
+
+	buf := bytes.Buffer{}
+	buf.WriteByte(byte(len(m.Token)))
+	buf.WriteByte(byte(m.Code))
+	buf.Write(m.Token)
+	m.marshalBody(&buf)
+	return buf.Bytes(), nil
+}
+
+// parseWS parses a WebSocket message, reading 7.xx messages as
+// signaling if signals is set.
+func parseWS(data []byte, signals bool) (*Message, error) {
+	if len(data) < 2 {
+		return nil, errors.New("short packet")
+	}
+	if data[0]>>4 != 0 {
+		return nil, errors.New("invalid length field")
+	}
+	tkl := int(data[0] & 0xf)
+	if tkl > 8 {
+		return nil, ErrInvalidTokenLen
+	}
+	if len(data) < 2+tkl {
+		return nil, errors.New("truncated")
+	}
+
+	m := Message{Code: CCode(data[1])}
+	if tkl > 0 {
+		m.Token = data[2 : 2+tkl]
+	}
+	return &m, m.unmarshalBody(data[2+tkl:], signals && isSignal(m.Code))
+}
+
+// wsStream carries one message per binary WebSocket message.
+type wsStream struct {
+	*websocket.Conn
+	remote net.Addr
+	tls    *tls.ConnectionState
+	d      Dialect
+
+	mu sync.Mutex
+}
+
+func newWSStream(ws *websocket.Conn, remote net.Addr, d Dialect) *wsStream {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsStream{Conn: ws, remote: remote, d: d.resolve(true)}
+}
+
+// RemoteAddr returns the address of the peer rather than the
+// WebSocket origin.
+func (s *wsStream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *wsStream) readMsg(maxSize int) (*Message, error) {
+	s.Conn.MaxPayloadBytes = maxSize
+	var data []byte
+	if err := websocket.Message.Receive(s.Conn, &data); err != nil {
+		if err == websocket.ErrFrameTooLarge {
+			return nil, ErrMessageTooLarge
+		}
+		return nil, err
+	}
+	return parseWS(data, s.signals())
+}
+
+func (s *wsStream) writeMsg(m *Message, maxSize int) error {
+	d, err := marshalWS(m)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && len(d) > maxSize {
+		return ErrMessageTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return websocket.Message.Send(s.Conn, d)
+}
+
+func (s *wsStream) signals() bool {
+	return s.d == DialectRFC
+}
+
+func (s *wsStream) dialect() Dialect {
+	return s.d
+}
+
+// errBadOrigin fails the handshakes Server.CheckOrigin rejects.
+var errBadOrigin = errors.New("websocket origin not allowed")
+
+// sameOrigin accepts handshakes without an Origin header or whose
+// Origin names the host the request was sent to, so that web pages
+// from other sites cannot reach the server through a visitor's
+// browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// WebSocketHandler returns an http.Handler serving CoAP over
+// WebSockets (RFC 8323 section 4) with the server's Handler.  Clients
+// must offer the "coap" subprotocol, and handshakes are checked with
+// CheckOrigin.  Connections are tracked by the server and released by
+// Shutdown and Close.
+func (srv *Server) WebSocketHandler() http.Handler {
+	limit := srv.newRequestLimit()
+	checkOrigin := srv.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !checkOrigin(r) {
+				return errBadOrigin
+			}
+			for _, p := range config.Protocol {
+				if p == wsProtocol {
+					config.Protocol = []string{wsProtocol}
+					return nil
+				}
+			}
+			return ErrNoSubprotocol
+		},
+		Handler: func(ws *websocket.Conn) {
+			r := ws.Request()
+			remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+			if err != nil {
+				ws.Close()
+				return
+			}
+			s := newWSStream(ws, remote, srv.Dialect)
+			s.tls = r.TLS
+
+			rh := srv.Handler
+			if rh == nil {
+				rh = HandlerFunc(notFoundHandler)
+			}
+			srv.serveStream(s, TransportWebSocket, rh, limit)
+		},
+	}
+}
+
+// DialWebSocket connects a CoAP client to the WebSocket endpoint at
+// urlStr, a ws:// or wss:// URL.  tlsConfig configures wss:// and may
+// be nil.  ErrNoSubprotocol is returned if the server does not select
+// the "coap" subprotocol.
+func DialWebSocket(urlStr string, tlsConfig *tls.Config) (*StreamConn, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	origin := *u
+	origin.Scheme = "http"
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+
+	config, err := websocket.NewConfig(urlStr, origin.String())
+	if err != nil {
+		return nil, err
+	}
+	offered := []string{wsProtocol}
+	config.Protocol = offered
+	config.TlsConfig = tlsConfig
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	// the handshake replaces the offered list only when the server
+	// selects a subprotocol
+	p := ws.Config().Protocol
+	if len(p) != 1 || p[0] != wsProtocol || &p[0] == &offered[0] {
+		ws.Close()
+		return nil, ErrNoSubprotocol
+	}
+	return newStreamConn(newWSStream(ws, ws.RemoteAddr(), DialectAuto))
+}
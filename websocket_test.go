@@ -0,0 +1,200 @@
+package coap
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestMarshalWS(t *testing.T) {
+	m := &Message{Code: GET, Token: []byte{0x01}, Payload: []byte("a")}
+	m.SetPathString("x")
+	d, err := marshalWS(m)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	exp := []byte{0x01, 0x01, 0x01, 0xb1, 'x', 0xff, 'a'}
+	if string(d) != string(exp) {
+		t.Fatalf("Expected %#v, got %#v", exp, d)
+	}
+
+	got, err := parseWS(d, true)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if got.Code != GET || got.PathString() != "x" || string(got.Payload) != "a" {
+		t.Errorf("Unexpected message %#v", got)
+	}
+
+	if _, err := parseWS([]byte{0x11, 0x01, 0x01}, true); err == nil {
+		t.Errorf("Expected an error for a non-zero length field")
+	}
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/hello", HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Transport != TransportWebSocket {
+			t.Errorf("Expected transport %v, got %v", TransportWebSocket, r.Transport)
+		}
+		if _, ok := r.RemoteAddr.(*net.TCPAddr); !ok {
+			t.Errorf("Expected a TCP remote address, got %v", r.RemoteAddr)
+		}
+		w.WriteMsg(&Message{Code: Content, Payload: append([]byte("hello "), r.Msg.Payload...)})
+	}))
+	srv := &Server{Handler: mux}
+	defer srv.Close()
+	hs := httptest.NewServer(srv.WebSocketHandler())
+	defer hs.Close()
+	u := "ws" + strings.TrimPrefix(hs.URL, "http") + "/.well-known/coap"
+
+	c, err := DialWebSocket(u, nil)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Code: POST, Payload: []byte("ws")}
+	req.SetPathString("/hello")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != Content || string(rv.Payload) != "hello ws" {
+		t.Errorf("Unexpected response %v %q", rv.Code, rv.Payload)
+	}
+	if c.MaxMessageSize() != DefaultMaxMessageSize {
+		t.Errorf("Expected Max-Message-Size %d, got %d", DefaultMaxMessageSize, c.MaxMessageSize())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("Error pinging: %v", err)
+	}
+
+	req = Message{Code: GET}
+	req.SetPathString("/missing")
+	rv, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != NotFound {
+		t.Errorf("Expected %v, got %v", NotFound, rv.Code)
+	}
+
+	// clients must ask for the coap subprotocol
+	config, err := websocket.NewConfig(u, hs.URL)
+	if err != nil {
+		t.Fatalf("Error configuring: %v", err)
+	}
+	if ws, err := websocket.DialConfig(config); err == nil {
+		ws.Close()
+		t.Errorf("Expected a connection without subprotocol to fail")
+	}
+}
+
+func TestWebSocketHandlerOrigin(t *testing.T) {
+	srv := &Server{}
+	defer srv.Close()
+	hs := httptest.NewServer(srv.WebSocketHandler())
+	defer hs.Close()
+	u := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	dial := func(origin string) error {
+		config, err := websocket.NewConfig(u, origin)
+		if err != nil {
+			t.Fatalf("Error configuring: %v", err)
+		}
+		config.Protocol = []string{wsProtocol}
+		ws, err := websocket.DialConfig(config)
+		if err == nil {
+			ws.Close()
+		}
+		return err
+	}
+
+	// pages from other sites are refused by default
+	if err := dial("http://example.com"); err == nil {
+		t.Errorf("Expected a foreign origin to be rejected")
+	}
+	if err := dial(hs.URL); err != nil {
+		t.Errorf("Expected the same origin to be accepted, got %v", err)
+	}
+
+	srv.CheckOrigin = func(r *http.Request) bool { return true }
+	hs2 := httptest.NewServer(srv.WebSocketHandler())
+	defer hs2.Close()
+	u = "ws" + strings.TrimPrefix(hs2.URL, "http")
+	if err := dial("http://example.com"); err != nil {
+		t.Errorf("Expected CheckOrigin to accept any origin, got %v", err)
+	}
+}
+
+func TestDialWebSocketNoSubprotocol(t *testing.T) {
+	hs := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			config.Protocol = nil
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.Close()
+		},
+	})
+	defer hs.Close()
+	u := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	if c, err := DialWebSocket(u, nil); err != ErrNoSubprotocol {
+		if c != nil {
+			c.Close()
+		}
+		t.Errorf("Expected ErrNoSubprotocol, got %v", err)
+	}
+}
+
+func TestWebSocketShutdownDelivers(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		close(entered)
+		<-release
+		w.WriteMsg(&Message{Code: Content, Payload: []byte("late")})
+	})}
+	hs := httptest.NewServer(srv.WebSocketHandler())
+	defer hs.Close()
+	u := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	c, err := DialWebSocket(u, nil)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	responses := make(chan *Message, 1)
+	go func() {
+		rv, err := c.Send(Message{Code: GET})
+		if err != nil {
+			t.Errorf("Error sending request: %v", err)
+		}
+		responses <- rv
+	}()
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	if rv := <-responses; rv == nil || string(rv.Payload) != "late" {
+		t.Errorf("Expected the in-flight response, got %v", rv)
+	}
+}